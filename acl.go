@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// parseCIDRList parses a comma separated list of CIDRs, such as
+// "192.0.2.0/24,2001:db8::/32". A bare address stands for itself alone.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDomainList parses a comma separated list of domains, such as
+// "example.org,example.net".
+func parseDomainList(list string) []string {
+	var domains []string
+	for _, domain := range strings.Split(list, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayRelayTo reports whether the client may send mail to the address
+// to. Mail for local domains is always accepted, anything else is
+// relaying and only allowed for RelayDomains or authenticated clients.
+func (c *connection) mayRelayTo(to string) bool {
+	// LMTP only hands over mail that is already known to be local
+	if c.authUser != "" || c.lmtp {
+		return true
+	}
+
+	at := strings.LastIndexByte(to, '@')
+	if at < 0 {
+		// Only postmaster comes without a domain
+		return true
+	}
+
+	domain := to[at+1:]
+	local := c.server.LocalDomains
+	if local == nil {
+		local = []string{c.server.hostname()}
+	}
+
+	return containsDomain(local, domain) || containsDomain(c.server.RelayDomains, domain)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+)
+
+// maxAliasDepth is how many aliases deep an expansion may go before it
+// is taken to be a loop.
+const maxAliasDepth = 10
+
+var errAliasLoop = errors.New("Alias loop")
+
+// AliasResolver rewrites recipients before delivery. It reports whether
+// address is an alias and if so returns the addresses mail to it goes
+// to instead, which may be aliases themselves.
+type AliasResolver interface {
+	Resolve(address string) ([]string, bool, error)
+}
+
+// MemoryAliases is an AliasResolver backed by a map of lower case
+// alias to its targets, e.g. "info@example.org" to "alice@example.org"
+// and "bob@example.org".
+type MemoryAliases map[string][]string
+
+func (m MemoryAliases) Resolve(address string) ([]string, bool, error) {
+	targets, ok := m[strings.ToLower(address)]
+	return targets, ok, nil
+}
+
+// loadMemoryAliases reads a file of "alias: target, target" lines.
+// Blank lines and lines starting with # are skipped.
+func loadMemoryAliases(path string) (MemoryAliases, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := MemoryAliases{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pieces := strings.SplitN(line, ":", 2)
+		if len(pieces) != 2 {
+			return nil, errors.New("Expected alias: target, target in " + path + " got: " + line)
+		}
+
+		alias := strings.ToLower(strings.TrimSpace(pieces[0]))
+		for _, target := range strings.Split(pieces[1], ",") {
+			target = strings.TrimSpace(target)
+			if !validAddress(target) {
+				return nil, errors.New("Invalid target address for " + alias + " in " + path + ": " + target)
+			}
+
+			m[alias] = append(m[alias], target)
+		}
+	}
+
+	return m, scanner.Err()
+}
+
+// expandAlias resolves address until only addresses that aren't
+// aliases are left, each returned once. An address that isn't an alias
+// comes back as it is, and so does an alias that lists itself.
+// errAliasLoop is returned if an alias leads back to itself through
+// others or the expansion goes deeper than maxAliasDepth.
+func expandAlias(r AliasResolver, address string) ([]string, error) {
+	var targets []string
+	// seen holds the addresses already expanded or added, so one
+	// reached along several paths only counts once, and onPath the
+	// aliases being expanded
+	seen := map[string]bool{}
+	onPath := map[string]bool{}
+
+	var expand func(address string, depth int) error
+	expand = func(address string, depth int) error {
+		key := strings.ToLower(address)
+		if onPath[key] || depth > maxAliasDepth {
+			return errAliasLoop
+		}
+
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+
+		members, ok, err := r.Resolve(address)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			targets = append(targets, address)
+			return nil
+		}
+
+		onPath[key] = true
+		self := false
+		for _, member := range members {
+			// An alias that lists itself, like "alice: alice, archive",
+			// keeps a copy in the mailbox rather than looping
+			if strings.ToLower(member) == key {
+				if !self {
+					targets = append(targets, member)
+					self = true
+				}
+				continue
+			}
+
+			err := expand(member, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		onPath[key] = false
+
+		return nil
+	}
+
+	err := expand(address, 0)
+	return targets, err
+}
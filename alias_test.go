@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// aliasChain is n aliases each leading to the next, the last to
+// bob@example.org.
+func aliasChain(n int) MemoryAliases {
+	m := MemoryAliases{}
+	for i := 0; i < n; i++ {
+		target := "alias" + strconv.Itoa(i+1) + "@example.org"
+		if i == n-1 {
+			target = "bob@example.org"
+		}
+		m["alias"+strconv.Itoa(i)+"@example.org"] = []string{target}
+	}
+
+	return m
+}
+
+func TestExpandAlias(t *testing.T) {
+	aliases := MemoryAliases{
+		"team@example.org":   {"carol@example.org", "Dave@example.org"},
+		"all@example.org":    {"team@example.org", "ops@example.org", "carol@example.org"},
+		"ops@example.org":    {"dave@example.org", "erin@example.org"},
+		"self@example.org":   {"Self@example.org"},
+		"alice@example.org":  {"alice@example.org", "archive@example.org", "ALICE@example.org"},
+		"ping@example.org":   {"pong@example.org"},
+		"pong@example.org":   {"carol@example.org", "ping@example.org"},
+		"nobody@example.org": nil,
+	}
+
+	tests := []struct {
+		address, want string
+		loop          bool
+	}{
+		{"bob@example.org", "bob@example.org", false},
+		{"TEAM@example.org", "carol@example.org,Dave@example.org", false},
+		// The same address along several paths isn't a loop
+		{"all@example.org", "carol@example.org,Dave@example.org,erin@example.org", false},
+		{"nobody@example.org", "", false},
+		// Listing itself delivers to the address rather than looping
+		{"self@example.org", "Self@example.org", false},
+		{"alice@example.org", "alice@example.org,archive@example.org", false},
+		{"ping@example.org", "", true},
+	}
+
+	for _, test := range tests {
+		expanded, err := expandAlias(aliases, test.address)
+		if test.loop {
+			if err != errAliasLoop {
+				t.Errorf("%s: expected a loop, got %q, %v", test.address, expanded, err)
+			}
+			continue
+		}
+
+		if err != nil || strings.Join(expanded, ",") != test.want {
+			t.Errorf("%s: expected %q, got %q, %v", test.address, test.want, expanded, err)
+		}
+	}
+}
+
+func TestExpandAliasDepth(t *testing.T) {
+	expanded, err := expandAlias(aliasChain(maxAliasDepth), "alias0@example.org")
+	if err != nil || strings.Join(expanded, ",") != "bob@example.org" {
+		t.Fatalf("Expected %d aliases deep to expand, got %q, %v", maxAliasDepth, expanded, err)
+	}
+
+	_, err = expandAlias(aliasChain(maxAliasDepth+1), "alias0@example.org")
+	if err != errAliasLoop {
+		t.Fatalf("Expected %d aliases deep to be taken as a loop, got %v", maxAliasDepth+1, err)
+	}
+}
+
+func TestLoadMemoryAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	err := os.WriteFile(path, []byte("# Aliases\n\nInfo@example.org: alice@example.org, bob@example.org\ninfo@example.org:carol@example.org\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadMemoryAliases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(m["info@example.org"], ","); len(m) != 1 || got != "alice@example.org,bob@example.org,carol@example.org" {
+		t.Fatalf("Unexpected aliases %q", m)
+	}
+
+	for _, content := range []string{"info@example.org alice@example.org\n", "info@example.org: alice\n"} {
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadMemoryAliases(path)
+		if err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+	}
+}
+
+func TestAliasLoopSession(t *testing.T) {
+	aliases := aliasChain(maxAliasDepth + 1)
+	aliases["ping@example.org"] = []string{"pong@example.org"}
+	aliases["pong@example.org"] = []string{"ping@example.org"}
+	s := &Server{AliasResolver: aliases}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	for _, to := range []string{"ping@example.org", "alias0@example.org"} {
+		if lines := tc.cmd("RCPT TO:<"+to+">", 550); lines[0] != "5.4.6 Alias loop detected" {
+			t.Fatalf("%s: unexpected reply %q", to, lines)
+		}
+	}
+	tc.cmd("RCPT TO:<alias1@example.org>", 250)
+	tc.cmd("QUIT", 221)
+}
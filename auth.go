@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Authenticator checks the credentials a client presents with AUTH.
+type Authenticator interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// SecretAuthenticator is an Authenticator that can also look up a
+// user's password, which challenge-response mechanisms such as CRAM-MD5
+// need. They are only offered with one.
+type SecretAuthenticator interface {
+	Authenticator
+	Secret(username string) (string, bool, error)
+}
+
+// ClientCertResolver maps the verified TLS client certificate of a
+// client using AUTH EXTERNAL to the identity it authenticates as. ok is
+// false if the certificate doesn't stand for anyone.
+type ClientCertResolver interface {
+	Identity(cert *x509.Certificate) (identity string, ok bool, err error)
+}
+
+// CommonNameResolver is a ClientCertResolver taking the certificate's
+// subject common name as the identity.
+type CommonNameResolver struct{}
+
+func (CommonNameResolver) Identity(cert *x509.Certificate) (string, bool, error) {
+	return cert.Subject.CommonName, cert.Subject.CommonName != "", nil
+}
+
+// MemoryAuthenticator is an Authenticator backed by a map of username
+// to password.
+type MemoryAuthenticator map[string]string
+
+func (m MemoryAuthenticator) Authenticate(username, password string) (bool, error) {
+	expected, ok := m[username]
+	if !ok {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1, nil
+}
+
+func (m MemoryAuthenticator) Secret(username string) (string, bool, error) {
+	secret, ok := m[username]
+	return secret, ok, nil
+}
+
+// loadMemoryAuthenticator reads a file of "username:password" lines.
+// Blank lines and lines starting with # are skipped.
+func loadMemoryAuthenticator(path string) (MemoryAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := MemoryAuthenticator{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pieces := strings.SplitN(line, ":", 2)
+		if len(pieces) != 2 {
+			return nil, errors.New("Expected username:password in " + path + " got: " + line)
+		}
+
+		m[pieces[0]] = pieces[1]
+	}
+
+	return m, scanner.Err()
+}
+
+// authMechanism is a SASL mechanism usable with AUTH. run carries out
+// the exchange, starting from the optional initial response, and
+// returns the reply to send once it is over. If available is set it
+// says whether the mechanism is offered on the connection.
+type authMechanism struct {
+	name      string
+	run       func(c *connection, initial string) (int, string, error)
+	available func(c *connection) bool
+}
+
+var authMechanisms = []authMechanism{
+	{name: "PLAIN", run: (*connection).authPlain, available: hasAuthenticator},
+	{name: "LOGIN", run: (*connection).authLogin, available: hasAuthenticator},
+	{name: "CRAM-MD5", run: (*connection).authCRAMMD5, available: func(c *connection) bool {
+		_, ok := c.server.Authenticator.(SecretAuthenticator)
+		return ok
+	}},
+	{name: "EXTERNAL", run: (*connection).authExternal, available: func(c *connection) bool {
+		return c.server.ClientCertResolver != nil && c.clientCertificate() != nil
+	}},
+}
+
+func hasAuthenticator(c *connection) bool {
+	return c.server.Authenticator != nil
+}
+
+func (mech authMechanism) offered(c *connection) bool {
+	return mech.available == nil || mech.available(c)
+}
+
+func (c *connection) authAvailable() bool {
+	return c.tls && c.authMechanismNames() != ""
+}
+
+// clientCertificate returns the client's TLS certificate, if it sent
+// one that verified.
+func (c *connection) clientCertificate() *x509.Certificate {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+func (c *connection) authMechanismNames() string {
+	var names []string
+	for _, mech := range authMechanisms {
+		if mech.offered(c) {
+			names = append(names, mech.name)
+		}
+	}
+
+	return strings.Join(names, " ")
+}
+
+// auth handles the AUTH command. An error is only returned when the
+// connection itself failed.
+func (c *connection) auth(arg string) (int, string, error) {
+	if c.server.Authenticator == nil && c.server.ClientCertResolver == nil {
+		return 502, "5.5.1 Command not implemented", nil
+	}
+
+	// AUTH has to come between EHLO and MAIL, RFC 4954 section 4
+	if !c.esmtp || c.authUser != "" || c.state != stateGreeted {
+		return 503, "5.5.1 Bad sequence of commands", nil
+	}
+
+	if c.mustStartTLS() {
+		return 530, "5.7.0 Must issue a STARTTLS command first", nil
+	}
+
+	if !c.tls {
+		return 538, "5.7.11 Encryption required for requested authentication mechanism", nil
+	}
+
+	pieces := strings.SplitN(arg, " ", 2)
+	name := strings.ToUpper(pieces[0])
+	initial := ""
+	if len(pieces) == 2 {
+		initial = strings.TrimSpace(pieces[1])
+	}
+
+	for _, mech := range authMechanisms {
+		if mech.name == name && mech.offered(c) {
+			return mech.run(c, initial)
+		}
+	}
+
+	return 504, "5.5.4 Unrecognized authentication type", nil
+}
+
+// challenge sends a 334 continuation carrying data and returns the
+// decoded client response. ok is false if the response was malformed
+// or the client cancelled the exchange.
+func (c *connection) challenge(data string) ([]byte, bool, error) {
+	// Unlike other replies, the space is required even when there is
+	// no data, RFC 4954 section 4
+	err := c.writeLine("334 " + base64.StdEncoding.EncodeToString([]byte(data)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, ok := decodeAuthResponse(line)
+	return response, ok, nil
+}
+
+func decodeAuthResponse(s string) ([]byte, bool) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return nil, false
+	}
+
+	// A lone "=" is an empty initial response
+	if s == "=" {
+		return []byte{}, true
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+
+	return b, true
+}
+
+// checkCredentials asks the server's Authenticator about username and
+// password and records the identity on success.
+func (c *connection) checkCredentials(username, password string) (int, string) {
+	ok, err := c.server.Authenticator.Authenticate(username, password)
+	return c.authResult(username, ok, err)
+}
+
+// authResult is the reply to an AUTH exchange for username that ended
+// with ok, and records the identity on success.
+func (c *connection) authResult(username string, ok bool, err error) (int, string) {
+	// The identity ends up in headers such as a synthesized From
+	if strings.ContainsAny(username, "\r\n") {
+		return 501, "5.5.2 Syntax error in parameters"
+	}
+
+	if err != nil {
+		c.logError(err)
+		return 454, "4.7.0 Temporary authentication failure"
+	}
+
+	c.server.Metrics.authAttempt(ok)
+	if !ok {
+		c.logInfo("Authentication failed for %s", username)
+		return 535, "5.7.8 Authentication failed"
+	}
+
+	c.authUser = username
+	c.logInfo("Authenticated as %s", username)
+	return 235, "2.7.0 Authentication successful"
+}
+
+func (c *connection) authPlain(initial string) (int, string, error) {
+	var response []byte
+	ok := true
+	if initial == "" {
+		var err error
+		response, ok, err = c.challenge("")
+		if err != nil {
+			return 0, "", err
+		}
+	} else {
+		response, ok = decodeAuthResponse(initial)
+	}
+
+	if !ok {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	// authzid NUL authcid NUL passwd, RFC 4616 section 2
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	authzid, username, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if authzid != "" && authzid != username {
+		return 535, "5.7.8 Authentication failed", nil
+	}
+
+	code, text := c.checkCredentials(username, password)
+	return code, text, nil
+}
+
+func (c *connection) authLogin(initial string) (int, string, error) {
+	var username []byte
+	ok := true
+	if initial == "" {
+		var err error
+		username, ok, err = c.challenge("Username:")
+		if err != nil {
+			return 0, "", err
+		}
+	} else {
+		username, ok = decodeAuthResponse(initial)
+	}
+
+	if !ok {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	password, ok, err := c.challenge("Password:")
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !ok {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	code, text := c.checkCredentials(string(username), string(password))
+	return code, text, nil
+}
+
+// authCRAMMD5 has the client prove it knows the password by keying an
+// HMAC-MD5 of a challenge with it, RFC 2195.
+func (c *connection) authCRAMMD5(initial string) (int, string, error) {
+	// The server speaks first
+	if initial != "" {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	challenge := "<" + newMessageID() + "@" + c.server.hostname() + ">"
+	response, ok, err := c.challenge(challenge)
+	if err != nil {
+		return 0, "", err
+	}
+
+	fields := strings.Fields(string(response))
+	if !ok || len(fields) != 2 {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	username, digest := fields[0], fields[1]
+	secret, found, err := c.server.Authenticator.(SecretAuthenticator).Secret(username)
+	if err == nil && found {
+		found = checkCRAMMD5(secret, challenge, digest)
+	}
+
+	code, text := c.authResult(username, found, err)
+	return code, text, nil
+}
+
+func checkCRAMMD5(secret, challenge, digest string) bool {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(digest))) == 1
+}
+
+// authExternal authenticates the client as whoever its TLS client
+// certificate stands for, RFC 4422 appendix A.
+func (c *connection) authExternal(initial string) (int, string, error) {
+	var authzid []byte
+	ok := true
+	if initial == "" {
+		var err error
+		authzid, ok, err = c.challenge("")
+		if err != nil {
+			return 0, "", err
+		}
+	} else {
+		authzid, ok = decodeAuthResponse(initial)
+	}
+
+	if !ok {
+		return 501, "5.5.2 Syntax error in parameters", nil
+	}
+
+	identity, found, err := c.server.ClientCertResolver.Identity(c.clientCertificate())
+	// Asking to act as someone else isn't supported
+	if found && len(authzid) > 0 && string(authzid) != identity {
+		found = false
+	}
+
+	code, text := c.authResult(identity, found, err)
+	return code, text, nil
+}
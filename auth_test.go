@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCheckCRAMMD5(t *testing.T) {
+	// RFC 2195 section 2
+	const (
+		challenge = "<1896.697170952@postoffice.reston.mci.net>"
+		secret    = "tanstaaftanstaaf"
+		digest    = "b913a602c7eda7a495b4e6e7334d3890"
+	)
+
+	if !checkCRAMMD5(secret, challenge, digest) {
+		t.Fatal("Expected the RFC 2195 response to verify")
+	}
+	if !checkCRAMMD5(secret, challenge, strings.ToUpper(digest)) {
+		t.Fatal("Expected an upper case digest to verify")
+	}
+	if checkCRAMMD5("tanstaaftanstaag", challenge, digest) {
+		t.Fatal("Expected the wrong secret not to verify")
+	}
+	if checkCRAMMD5(secret, "<1897.697170952@postoffice.reston.mci.net>", digest) {
+		t.Fatal("Expected another challenge not to verify")
+	}
+	if checkCRAMMD5(secret, challenge, digest[:30]) {
+		t.Fatal("Expected a short digest not to verify")
+	}
+}
+
+// passwordAuthenticator is an Authenticator that can't give out the
+// secret CRAM-MD5 needs.
+type passwordAuthenticator map[string]string
+
+func (p passwordAuthenticator) Authenticate(username, password string) (bool, error) {
+	return p[username] != "" && p[username] == password, nil
+}
+
+// cramMD5Response answers a CRAM-MD5 challenge, the text of a 334
+// reply.
+func cramMD5Response(t *testing.T, username, secret, challenge string) string {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		t.Fatalf("Malformed challenge %q", challenge)
+	}
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(decoded)
+	response := username + " " + hex.EncodeToString(mac.Sum(nil))
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+func TestAuthCRAMMD5(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	s := &Server{
+		Authenticator: MemoryAuthenticator{"tim": "tanstaaftanstaaf"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+	extensions := tc.cmd("EHLO client.example.com", 250)[1:]
+	if !containsLine(extensions, "AUTH PLAIN LOGIN CRAM-MD5") {
+		t.Fatalf("Expected CRAM-MD5 to be advertised, got %q", extensions)
+	}
+
+	// The server sends the challenge
+	tc.cmd("AUTH CRAM-MD5 dGlt", 501)
+
+	challenge := tc.cmd("AUTH CRAM-MD5", 334)[0]
+	tc.cmd(cramMD5Response(t, "tim", "wrong", challenge), 535)
+
+	challenge = tc.cmd("AUTH CRAM-MD5", 334)[0]
+	tc.cmd(cramMD5Response(t, "nobody", "tanstaaftanstaaf", challenge), 535)
+
+	challenge = tc.cmd("AUTH CRAM-MD5", 334)[0]
+	tc.cmd("*", 501)
+
+	// Each challenge is new
+	first := tc.cmd("AUTH CRAM-MD5", 334)[0]
+	tc.cmd(cramMD5Response(t, "tim", "tanstaaftanstaaf", challenge), 535)
+	second := tc.cmd("AUTH CRAM-MD5", 334)[0]
+	if first == second {
+		t.Fatalf("Got the same challenge twice: %q", first)
+	}
+	tc.cmd(cramMD5Response(t, "tim", "tanstaaftanstaaf", second), 235)
+	tc.cmd("AUTH CRAM-MD5", 503)
+	tc.cmd("QUIT", 221)
+}
+
+func TestAuthCRAMMD5NeedsSecrets(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	s := &Server{
+		Authenticator: passwordAuthenticator{"tim": "tanstaaftanstaaf"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+	extensions := tc.cmd("EHLO client.example.com", 250)[1:]
+	if !containsLine(extensions, "AUTH PLAIN LOGIN") {
+		t.Fatalf("Expected CRAM-MD5 not to be advertised, got %q", extensions)
+	}
+
+	tc.cmd("AUTH CRAM-MD5", 504)
+	// tim, tanstaaftanstaaf
+	tc.cmd("AUTH PLAIN AHRpbQB0YW5zdGFhZnRhbnN0YWFm", 235)
+	tc.cmd("QUIT", 221)
+}
+
+func TestAuthIdentityWithLineBreak(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	s := &Server{
+		Authenticator: passwordAuthenticator{"tim\r\nX-Injected: yes": "secret", "tim": "secret"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+	tc.cmd("EHLO client.example.com", 250)
+
+	// Even when the Authenticator accepts it
+	response := base64.StdEncoding.EncodeToString([]byte("\x00tim\r\nX-Injected: yes\x00secret"))
+	tc.cmd("AUTH PLAIN "+response, 501)
+	response = base64.StdEncoding.EncodeToString([]byte("\x00tim\x00secret"))
+	tc.cmd("AUTH PLAIN "+response, 235)
+	tc.cmd("QUIT", 221)
+}
+
+func TestAuthSequence(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	s := &Server{
+		Authenticator: passwordAuthenticator{"tim": "secret"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	addr := startServer(t, s)
+	response := base64.StdEncoding.EncodeToString([]byte("\x00tim\x00secret"))
+
+	// Before EHLO, and checked ahead of the TLS requirement
+	tc := connect(t, addr)
+	tc.cmd("AUTH PLAIN "+response, 503)
+	tc.cmd("HELO client.example.com", 250)
+	tc.cmd("AUTH PLAIN "+response, 503)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+	tc.cmd("EHLO client.example.com", 250)
+
+	// During a transaction, which goes on
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("AUTH PLAIN "+response, 503)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.cmd("AUTH PLAIN "+response, 503)
+	tc.cmd("RSET", 250)
+	tc.cmd("AUTH PLAIN "+response, 235)
+	tc.cmd("QUIT", 221)
+}
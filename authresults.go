@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+)
+
+// authResultsHeader summarizes the SPF and DKIM checks that ran on m in
+// an Authentication-Results header, RFC 8601. It returns false if none
+// did.
+func (c *connection) authResultsHeader(m *message) (header, bool) {
+	var results []string
+	if m.spf != "" {
+		if m.envelopeFrom == "" {
+			results = append(results, "spf="+string(m.spf)+" smtp.helo="+m.clientDomain)
+		} else {
+			results = append(results, "spf="+string(m.spf)+" smtp.mailfrom="+m.envelopeFrom)
+		}
+	}
+
+	if c.server.VerifyDKIM {
+		if len(m.dkim) == 0 {
+			results = append(results, "dkim=none")
+		}
+
+		for _, r := range m.dkim {
+			result := "dkim=" + r.result
+			if r.reason != "" {
+				result += " reason=" + quoteAuthResultsValue(r.reason)
+			}
+			if r.domain != "" {
+				result += " header.d=" + r.domain
+			}
+			if r.selector != "" {
+				result += " header.s=" + r.selector
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	if len(results) == 0 {
+		return header{}, false
+	}
+
+	value := c.server.hostname() + ";\r\n\t" + strings.Join(results, ";\r\n\t")
+	return header{
+		name:  "Authentication-Results",
+		value: strings.ReplaceAll(value, "\r\n\t", " "),
+		raw:   "Authentication-Results: " + value,
+	}, true
+}
+
+func quoteAuthResultsValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// removeAuthResults drops Authentication-Results headers that claim to
+// come from hostname. Only this server's own can be trusted, any that
+// arrived with the message were forged, RFC 8601 section 5.
+func (m *message) removeAuthResults(hostname string) {
+	kept := m.atmHeaders[:0]
+	for _, h := range m.atmHeaders {
+		if strings.EqualFold(h.name, "Authentication-Results") {
+			authserv := strings.TrimSpace(strings.SplitN(h.value, ";", 2)[0])
+			// The authserv-id may be followed by a version
+			if fields := strings.Fields(authserv); len(fields) > 0 && strings.EqualFold(fields[0], hostname) {
+				continue
+			}
+		}
+
+		kept = append(kept, h)
+	}
+
+	m.atmHeaders = kept
+}
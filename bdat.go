@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// bdat handles BDAT, which sends the message content in chunks of a
+// given size instead of ending it with a dot, RFC 3030.
+func (c *connection) bdat(arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	size, err := strconv.Atoi(fields[0])
+	if err != nil || size < 0 {
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	// A chunk that big can't even be skipped in reasonable time to stay
+	// in step with the client, so the session ends
+	if size > hardMaxMessageSize {
+		c.reply(552, "5.3.4 Message size exceeds fixed limit")
+		return errMessageTooLarge
+	}
+
+	// The chunk follows whatever the reply is, so it has to be read
+	// even when it is going to be thrown away
+	last := len(fields) == 2
+	if len(fields) > 2 || last && !strings.EqualFold(fields[1], "LAST") {
+		err = c.discardChunk(size)
+		if err != nil {
+			return err
+		}
+
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	if c.state != stateRcpt && c.state != stateChunking {
+		err = c.discardChunk(size)
+		if err != nil {
+			return err
+		}
+
+		return c.badSequence()
+	}
+
+	received := 0
+	if c.msg.chunks != nil {
+		received = c.msg.chunks.Len()
+	}
+
+	if size > c.server.maxMessageSize()-received {
+		err = c.discardChunk(size)
+		if err != nil {
+			return err
+		}
+
+		c.state = stateGreeted
+		c.msg = newMessage(c.msg.clientDomain)
+		return c.reply(552, "5.3.4 Message size exceeds fixed limit")
+	}
+
+	err = c.readChunk(size)
+	if err != nil {
+		return c.abortData(err)
+	}
+
+	if !last {
+		c.state = stateChunking
+		return c.reply(250, "OK")
+	}
+
+	msg := &c.msg
+	data := ""
+	if msg.chunks != nil {
+		data = msg.chunks.String()
+	}
+	msg.chunks = nil
+	body, err := c.parseHeaders(msg, data)
+	if err != nil {
+		c.state = stateGreeted
+		c.msg = newMessage(msg.clientDomain)
+		c.reply(552, "5.3.4 Header exceeds fixed limit")
+		return err
+	}
+
+	// The body keeps its line breaks, except for the final one that
+	// DATA would have taken as part of the terminator
+	msg.body = strings.TrimSuffix(body, "\r\n")
+	return c.deliver()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bounceFailure is a recipient a message could not be delivered to.
+type bounceFailure struct {
+	recipient string
+	// reply is what the server that refused it said, e.g. "550 5.1.1
+	// No such user".
+	reply string
+}
+
+var enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// status is the enhanced status code of the failure, RFC 3463, taken
+// from the reply if it has one.
+func (f bounceFailure) status() string {
+	fields := strings.Fields(f.reply)
+	if len(fields) > 1 && enhancedStatus.MatchString(fields[1]) {
+		return fields[1]
+	}
+
+	return "5.0.0"
+}
+
+// newBounce builds a delivery status notification, RFC 3464, telling
+// the sender of m that it could not be delivered to failed. It reports
+// false when there is no one to tell: bounces are never bounced, and
+// recipients may have asked not to be notified, RFC 3461 section 4.1.
+func newBounce(hostname, remoteMTA string, m *message, failed []bounceFailure) (*message, bool) {
+	if m.envelopeFrom == "" {
+		return nil, false
+	}
+
+	var notify []bounceFailure
+	dsn := map[string]dsnRecipient{}
+	for i, to := range m.envelopeTo {
+		if i < len(m.dsn) {
+			dsn[to] = m.dsn[i]
+		}
+	}
+	for _, f := range failed {
+		if dsn[f.recipient].notifies("FAILURE") {
+			notify = append(notify, f)
+		}
+	}
+	if len(notify) == 0 {
+		return nil, false
+	}
+
+	id := newMessageID()
+	boundary := "=_" + id
+	bounce := &message{
+		id:           id,
+		clientDomain: hostname,
+		envelopeTo:   []string{m.envelopeFrom},
+		smtputf8:     m.smtputf8,
+		// A bounce must not get a NOTIFY of its own
+		dsn: []dsnRecipient{{notify: []string{"NEVER"}}},
+	}
+
+	for _, h := range [][2]string{
+		{"From", "Mail Delivery System <MAILER-DAEMON@" + hostname + ">"},
+		{"To", "<" + m.envelopeFrom + ">"},
+		{"Subject", "Undelivered Mail Returned to Sender"},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + id + "@" + hostname + ">"},
+		{"Auto-Submitted", "auto-replied"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/report; report-type=delivery-status; boundary="` + boundary + `"`},
+	} {
+		bounce.addHeader(header{name: h[0], value: h[1], raw: h[0] + ": " + h[1]})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "This is the mail system at %s.\r\n\r\n", hostname)
+	b.WriteString("Your message could not be delivered to one or more recipients:\r\n\r\n")
+	for _, f := range notify {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", f.recipient, f.reply)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", hostname)
+	if m.dsnEnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", m.dsnEnvID)
+	}
+	for _, f := range notify {
+		b.WriteString("\r\n")
+		if orcpt := dsn[f.recipient].orcpt; orcpt != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", orcpt)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", f.recipient)
+		b.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&b, "Status: %s\r\n", f.status())
+		if remoteMTA != "" {
+			fmt.Fprintf(&b, "Remote-MTA: dns; %s\r\n", remoteMTA)
+		}
+		fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", f.reply)
+	}
+
+	// The original goes back whole unless the sender only wanted its
+	// headers, RFC 3461 section 4.3
+	if m.dsnRet == "HDRS" {
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+		for _, h := range m.atmHeaders {
+			b.WriteString(h.raw + "\r\n")
+		}
+	} else {
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		b.Write(m.content())
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s--", boundary)
+	bounce.body = b.String()
+	return bounce, true
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type connection struct {
+	server *Server
+	conn   net.Conn
+	id     int
+	// r buffers what the client sends, see connReader.
+	r *bufio.Reader
+	// w buffers replies until the next read, so the replies to
+	// pipelined commands go out together.
+	w *bufio.Writer
+	// ctx is the session's context, see handle. Reads give up when it
+	// is done and it is passed on to lookups and the handler.
+	ctx context.Context
+
+	// lmtp is set for LMTP sessions, see Server.ServeLMTP.
+	lmtp bool
+	// esmtp is set when the client greeted with EHLO (or LHLO) rather
+	// than HELO.
+	esmtp bool
+	// tls is set once the connection is encrypted.
+	tls bool
+	// tlsState is what was negotiated, once the handshake is complete.
+	tlsState *tls.ConnectionState
+	// trusted is set for clients exempt from rate limiting and
+	// greylisting, see Server.AllowListSkipsChecks.
+	trusted bool
+	// remoteHost is the client's hostname from reverse DNS, see
+	// Server.LookupRemoteHost. remoteHostVerified is set when it was
+	// forward-confirmed.
+	remoteHost         string
+	remoteHostVerified bool
+	// authUser is the identity the client authenticated as, if any.
+	authUser string
+	// xclientAddr and xclientHelo are the client's address and the
+	// domain it greeted with, as passed on by a front-end with XCLIENT.
+	xclientAddr net.Addr
+	xclientHelo string
+
+	state sessionState
+	// msg is the transaction in progress.
+	msg message
+}
+
+// reject turns the client away with a reply before the session starts,
+// and closes the connection.
+func (c *connection) reject(code int, text string) {
+	defer c.conn.Close()
+	c.logInfo("Rejecting connection: %s", text)
+
+	err := c.reply(code, text)
+	if err == nil {
+		err = c.flush()
+	}
+	if err != nil {
+		c.logError(err)
+	}
+}
+
+// remoteAddr describes where the client is connecting from. Unix
+// socket clients are unnamed, so the socket they came in on stands in.
+func (c *connection) remoteAddr() string {
+	addr := c.clientAddr()
+	if addr.Network() == "unix" {
+		return "unix:" + c.conn.LocalAddr().String()
+	}
+
+	return addr.String()
+}
+
+// clientAddr is the address of the client, which is the connection's
+// remote address unless a front-end passed on another with XCLIENT.
+func (c *connection) clientAddr() net.Addr {
+	if c.xclientAddr != nil {
+		return c.xclientAddr
+	}
+
+	return c.conn.RemoteAddr()
+}
+
+// log sends an event to the server's Logger, tagged with the
+// connection id and remote address.
+func (c *connection) log(level Level, msg string, fields ...Field) {
+	fields = append([]Field{
+		{Key: FieldConnID, Value: c.id},
+		{Key: FieldRemoteAddr, Value: c.remoteAddr()},
+	}, fields...)
+	if c.msg.id != "" {
+		fields = append(fields, Field{Key: FieldMessageID, Value: c.msg.id})
+	}
+	c.server.logger().Log(level, msg, fields...)
+}
+
+func (c *connection) logInfo(msg string, args ...interface{}) {
+	c.log(LevelInfo, fmt.Sprintf(msg, args...))
+}
+
+func (c *connection) logError(err error) {
+	c.log(LevelError, err.Error())
+}
+
+// connReader reads from whatever the connection currently is, which
+// changes on STARTTLS, see read.
+type connReader struct {
+	c *connection
+}
+
+func (r connReader) Read(b []byte) (int, error) {
+	return r.c.read(b)
+}
+
+// read reads the next chunk from the client into b, for c.r. If the
+// client stays idle past the read timeout, or the server starts
+// shutting down, it is told so before the error is returned.
+func (c *connection) read(b []byte) (int, error) {
+	var deadline time.Time
+	if c.server.ReadTimeout > 0 {
+		deadline = time.Now().Add(c.server.ReadTimeout)
+	}
+	if d, ok := c.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		c.conn.SetReadDeadline(deadline)
+	}
+
+	// Checked after setting the deadline so a shutdown that starts in
+	// between still interrupts the read below
+	if c.server.shuttingDown() {
+		c.reply(421, "4.3.2 Service shutting down, closing connection")
+		return 0, errShuttingDown
+	}
+
+	if err := c.ctx.Err(); err != nil {
+		c.sessionExpired(err)
+		return 0, err
+	}
+
+	// The client may be waiting for replies before it sends more
+	err := c.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.conn.Read(b)
+	if err != nil {
+		if c.server.shuttingDown() {
+			c.reply(421, "4.3.2 Service shutting down, closing connection")
+			return n, errShuttingDown
+		}
+
+		if c.sessionExpired(c.ctx.Err()) {
+			return n, c.ctx.Err()
+		}
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			c.reply(421, "4.4.2 Timeout, closing connection")
+		}
+
+		return n, err
+	}
+
+	return n, nil
+}
+
+// sessionExpired tells the client the session is over if err is the
+// session context running past Server.MaxSessionDuration.
+func (c *connection) sessionExpired(err error) bool {
+	if err != context.DeadlineExceeded {
+		return false
+	}
+
+	c.reply(421, "4.4.2 Session time limit exceeded, closing connection")
+	return true
+}
+
+// discardBuffered throws away whatever the client sent that hasn't
+// been read yet.
+func (c *connection) discardBuffered() {
+	c.r.Discard(c.r.Buffered())
+}
+
+func (c *connection) lineTooLong() error {
+	c.discardBuffered()
+	return errLineTooLong
+}
+
+func (c *connection) readLine() (string, error) {
+	return c.readLineMax(c.server.MaxLineLength)
+}
+
+// readLineMax reads a line, failing once it grows past max bytes. Zero
+// means no limit.
+func (c *connection) readLineMax(max int) (string, error) {
+	line, _, err := c.readLineEnding(max)
+	if err == errLineTooLong {
+		c.reply(500, "5.5.2 Line too long")
+	}
+
+	return line, err
+}
+
+// readLineEnding is readLineMax, also reporting whether the line ended
+// in CRLF rather than a bare LF. It leaves replying to a line that is
+// too long to the caller.
+func (c *connection) readLineEnding(max int) (string, bool, error) {
+	line, err := c.readRawLine(max)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Be lenient and accept a bare LF as well as CRLF, plenty of
+	// clients (and telnet) send one
+	line = strings.TrimSuffix(line, "\n")
+	crlf := strings.HasSuffix(line, "\r")
+	return strings.TrimSuffix(line, "\r"), crlf, nil
+}
+
+// readRawLine reads up to and including the next LF, failing once the
+// line grows past max bytes. Zero means no limit. A pipelining client
+// may have sent more than one line at once, whatever is already
+// buffered is read first.
+func (c *connection) readRawLine(max int) (string, error) {
+	var line []byte
+	for {
+		// Unlike ReadString, ReadSlice stops when the buffer fills, so
+		// an overlong line is caught before it is read in full
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if max > 0 && len(line) > max {
+			return "", c.lineTooLong()
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return string(line), nil
+	}
+}
+
+// readToEndOfBody reads the rest of the body, up to the line holding
+// only the period that closes it, and returns it unstuffed. first is
+// the line that starts the body, with its line ending, if it has been
+// read already. It fails once the body grows past max bytes, counting
+// its last line ending but not the periods taken out.
+func (c *connection) readToEndOfBody(first string, max int) (string, error) {
+	if max < 0 {
+		c.discardBuffered()
+		return "", errMessageTooLarge
+	}
+
+	var body strings.Builder
+	// The period only closes the body after a CRLF, the body starts on
+	// a line of its own so the first line counts as following one
+	afterCRLF := true
+	line := first
+	for {
+		if line == "" {
+			// A stuffed line is a period longer than it counts, and the
+			// closing period still fits once the body is at max
+			limit := max - body.Len() + len(".")
+			if limit < len(".\r\n") {
+				limit = len(".\r\n")
+			}
+
+			var err error
+			line, err = c.readRawLine(limit)
+			if err == errLineTooLong {
+				return "", errMessageTooLarge
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if line == ".\r\n" && afterCRLF {
+			// The CRLF before the closing period is the end of the last
+			// line, not part of its content
+			return strings.TrimSuffix(body.String(), "\r\n"), nil
+		}
+
+		afterCRLF = strings.HasSuffix(line, "\r\n")
+		// The period a client adds to the start of every line that
+		// begins with one, so it can't be mistaken for the end of data,
+		// RFC 5321 section 4.5.2
+		line = strings.TrimPrefix(line, ".")
+		if body.Len()+len(line) > max {
+			c.discardBuffered()
+			return "", errMessageTooLarge
+		}
+
+		body.WriteString(line)
+		line = ""
+	}
+}
+
+// readChunk reads exactly n bytes, the content of a BDAT command, onto
+// the end of the message's content.
+func (c *connection) readChunk(n int) error {
+	if c.msg.chunks == nil {
+		c.msg.chunks = &strings.Builder{}
+	}
+
+	// Copying grows the content as it arrives, the size the client
+	// declared isn't allocated up front
+	_, err := io.CopyN(c.msg.chunks, c.r, int64(n))
+	return err
+}
+
+// discardChunk reads n bytes and throws them away, without buffering
+// them all at once.
+func (c *connection) discardChunk(n int) error {
+	_, err := c.r.Discard(n)
+	return err
+}
+
+// connWriter writes to whatever the connection currently is, which
+// changes on STARTTLS.
+type connWriter struct {
+	c *connection
+}
+
+func (w connWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.c.conn.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// writeLine buffers one line of a reply, see flush.
+func (c *connection) writeLine(msg string) error {
+	if c.w == nil {
+		c.w = bufio.NewWriter(connWriter{c})
+	}
+
+	_, err := c.w.WriteString(msg + "\r\n")
+	return err
+}
+
+// flush sends the buffered replies. It has to be called before reading
+// from the client and before closing the connection.
+func (c *connection) flush() error {
+	if c.w == nil || c.w.Buffered() == 0 {
+		return nil
+	}
+
+	if c.server.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+
+	return c.w.Flush()
+}
+
+// tarpit holds back a reply with code for as long as Server.Tarpit
+// asks. Replies already buffered are sent first, and the wait is cut
+// short when the server shuts down.
+func (c *connection) tarpit(code int) error {
+	if c.server.Tarpit == nil {
+		return nil
+	}
+
+	delay := c.server.Tarpit(c.clientAddr(), code)
+	if delay <= 0 {
+		return nil
+	}
+
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+
+	// Connections turned away before the session starts have no
+	// context yet, and a nil channel never fires
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.server.shutdownStarted():
+	case <-done:
+		return c.ctx.Err()
+	}
+
+	return nil
+}
+
+// reply writes a single-line SMTP reply. The text is optional; when it
+// is empty only the code is sent, without a trailing space.
+func (c *connection) reply(code int, text string) error {
+	err := c.tarpit(code)
+	if err != nil {
+		return err
+	}
+
+	c.server.Metrics.reply(code)
+	text = c.enhancedText(code, text)
+	c.log(LevelDebug, strings.TrimSpace(fmt.Sprintf("Sent reply: %d %s", code, text)), Field{Key: FieldCode, Value: code})
+	if text == "" {
+		return c.writeLine(strconv.Itoa(code))
+	}
+
+	return c.writeLine(fmt.Sprintf("%d %s", code, text))
+}
+
+// enhancedText puts an enhanced status code, RFC 3463, in front of the
+// text of a reply to a client that greeted with EHLO, which is offered
+// ENHANCEDSTATUSCODES, RFC 2034. Text may start with a code of its own,
+// otherwise the one for the reply's class is used. Other clients don't
+// expect them, so a code the text starts with is removed. Intermediate
+// 3xx replies go without.
+func (c *connection) enhancedText(code int, text string) string {
+	enhanced, rest := splitEnhancedCode(text)
+	if !c.esmtp || code < 200 || code >= 300 && code < 400 {
+		return rest
+	}
+
+	if enhanced == "" {
+		enhanced = strconv.Itoa(code/100) + ".0.0"
+	}
+
+	return strings.TrimSpace(enhanced + " " + rest)
+}
+
+// splitEnhancedCode splits an enhanced status code like "5.1.1" off the
+// start of text, if it starts with one.
+func splitEnhancedCode(text string) (string, string) {
+	first, rest := text, ""
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		first, rest = text[:i], text[i+1:]
+	}
+
+	if !enhancedStatus.MatchString(first) {
+		return "", text
+	}
+
+	return first, rest
+}
+
+// replyLines writes a multiline SMTP reply, each line with an enhanced
+// status code like reply gives.
+func (c *connection) replyLines(code int, lines []string) error {
+	enhanced := make([]string, len(lines))
+	for i, line := range lines {
+		enhanced[i] = c.enhancedText(code, line)
+	}
+
+	return c.writeReplyLines(code, enhanced)
+}
+
+// writeReplyLines writes a multiline SMTP reply as given: every line but
+// the last is joined to the code with a hyphen, the last one with a
+// space.
+func (c *connection) writeReplyLines(code int, lines []string) error {
+	err := c.tarpit(code)
+	if err != nil {
+		return err
+	}
+
+	c.server.Metrics.reply(code)
+	c.log(LevelDebug, fmt.Sprintf("Sent reply: %d %s", code, strings.Join(lines, " / ")), Field{Key: FieldCode, Value: code})
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		err := c.writeLine(strconv.Itoa(code) + sep + line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeConnection returns a connection on one end of a net.Pipe, ready
+// for its read helpers, without running a session on it. Every chunk
+// is written to the other end with a Write of its own, which the
+// connection reads separately, and then that end is closed. Replies
+// are read and thrown away.
+func pipeConnection(t *testing.T, s *Server, chunks ...string) *connection {
+	t.Helper()
+
+	if s.Logger == nil {
+		s.Logger = discardLogger{}
+	}
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	go func() {
+		for _, chunk := range chunks {
+			_, err := io.WriteString(client, chunk)
+			if err != nil {
+				return
+			}
+		}
+		client.Close()
+	}()
+	go io.Copy(io.Discard, client)
+
+	c := &connection{server: s, conn: server, ctx: context.Background()}
+	c.r = bufio.NewReader(connReader{c})
+	return c
+}
+
+func readLines(c *connection) ([]string, error) {
+	var lines []string
+	for {
+		line, err := c.readLine()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	tests := []struct {
+		name   string
+		chunks []string
+		lines  []string
+	}{
+		{"CRLF", []string{"EHLO a\r\n", "QUIT\r\n"}, []string{"EHLO a", "QUIT"}},
+		{"bare LF", []string{"EHLO a\n", "QUIT\n"}, []string{"EHLO a", "QUIT"}},
+		{"mixed", []string{"EHLO a\r\nNOOP\nQUIT\r\n"}, []string{"EHLO a", "NOOP", "QUIT"}},
+		{"several in one read", []string{"MAIL FROM:<a@b>\r\nRCPT TO:<c@d>\r\nDATA\r\n"},
+			[]string{"MAIL FROM:<a@b>", "RCPT TO:<c@d>", "DATA"}},
+		{"split across reads", []string{"EH", "LO a", "\r", "\nQU", "IT\r\n"}, []string{"EHLO a", "QUIT"}},
+		{"CRLF split between reads", []string{"NOOP\r", "\nQUIT\r", "\n"}, []string{"NOOP", "QUIT"}},
+		{"bare CR kept", []string{"NOOP a\rb\r\n"}, []string{"NOOP a\rb"}},
+		{"blank lines", []string{"\r\n\n"}, []string{"", ""}},
+		{"longer than the buffer", []string{long[:5000], long[5000:] + "\r\n"}, []string{long}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := pipeConnection(t, &Server{}, test.chunks...)
+			lines, err := readLines(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(lines, "|") != strings.Join(test.lines, "|") {
+				t.Fatalf("Expected %q, got %q", test.lines, lines)
+			}
+		})
+	}
+}
+
+func TestReadLineUnterminated(t *testing.T) {
+	c := pipeConnection(t, &Server{}, "QUIT")
+	_, err := c.readLine()
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestReadLineTooLong(t *testing.T) {
+	c := pipeConnection(t, &Server{MaxLineLength: 512},
+		"NOOP\r\n", strings.Repeat("x", 300), strings.Repeat("x", 300), "\r\nQUIT\r\n")
+
+	line, err := c.readLine()
+	if err != nil || line != "NOOP" {
+		t.Fatalf("Expected NOOP, got %q, %v", line, err)
+	}
+
+	_, err = c.readLine()
+	if err != errLineTooLong {
+		t.Fatalf("Expected errLineTooLong, got %v", err)
+	}
+
+	// The limit counts the line ending
+	c = pipeConnection(t, &Server{MaxLineLength: 8}, "NOOP a\r\n", "NOOP ab\r\n")
+	line, err = c.readLine()
+	if err != nil || line != "NOOP a" {
+		t.Fatalf("Expected NOOP a, got %q, %v", line, err)
+	}
+
+	_, err = c.readLine()
+	if err != errLineTooLong {
+		t.Fatalf("Expected errLineTooLong, got %v", err)
+	}
+}
+
+func TestReadToEndOfBody(t *testing.T) {
+	// A body whose closing period starts right at the end of the
+	// reader's buffer
+	boundary := strings.Repeat("x", 4096-len("\r\n")) + "\r\n"
+	tests := []struct {
+		name   string
+		first  string
+		chunks []string
+		body   string
+	}{
+		{"empty", "", []string{".\r\n"}, ""},
+		{"one line", "", []string{"Hello\r\n.\r\n"}, "Hello"},
+		{"several lines", "", []string{"One\r\nTwo\r\n\r\nThree\r\n.\r\n"}, "One\r\nTwo\r\n\r\nThree"},
+		{"first line given", "Hello\r\n", []string{"World\r\n.\r\n"}, "Hello\r\nWorld"},
+		{"first line is the end", ".\r\n", nil, ""},
+		{"dot-stuffed", "", []string{"..\r\n..data\r\n...\r\n.\r\n"}, ".\r\n.data\r\n.."},
+		{"dot elsewhere", "", []string{"a.\r\n .\r\n.\r\n"}, "a.\r\n ."},
+		{"terminator split", "", []string{"Hello\r\n.", "\r\n"}, "Hello"},
+		{"terminator split after CR", "", []string{"Hello\r\n.\r", "\n"}, "Hello"},
+		{"CRLF before terminator split", "", []string{"Hello\r", "\n.\r\n"}, "Hello"},
+		{"split everywhere", "", strings.Split("Hi\r\nthere\r\n.\r\n", ""), "Hi\r\nthere"},
+		{"at buffer boundary", "", []string{boundary + ".\r\n"}, strings.TrimSuffix(boundary, "\r\n")},
+		{"past buffer boundary", "", []string{boundary + "y\r\n.\r\n"}, boundary + "y"},
+		// Only a period after CRLF closes the body
+		{"period after bare LF", "", []string{"Hello\n.\r\nWorld\r\n.\r\n"}, "Hello\n\r\nWorld"},
+		{"bare LF after period", "", []string{"Hello\r\n.\nWorld\r\n.\r\n"}, "Hello\r\n\nWorld"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := pipeConnection(t, &Server{}, test.chunks...)
+			body, err := c.readToEndOfBody(test.first, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if body != test.body {
+				t.Fatalf("Expected %q, got %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestReadToEndOfBodyUnterminated(t *testing.T) {
+	c := pipeConnection(t, &Server{}, "Hello\r\n", ".")
+	_, err := c.readToEndOfBody("", 1<<20)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestReadToEndOfBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		max  int
+		ok   bool
+	}{
+		{"at the limit", "12345\r\n1234\r\n.\r\n", 13, true},
+		{"over the limit", "12345\r\n12345\r\n.\r\n", 13, false},
+		{"one long line", strings.Repeat("x", 100) + "\r\n.\r\n", 13, false},
+		{"stuffed period left out", "..12\r\n.\r\n", 5, true},
+		{"nothing allowed", "x\r\n.\r\n", 0, false},
+		{"empty with nothing allowed", ".\r\n", 0, true},
+		{"empty with less than nothing", ".\r\n", -1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := pipeConnection(t, &Server{}, test.data)
+			_, err := c.readToEndOfBody("", test.max)
+			if test.ok && err != nil {
+				t.Fatalf("Expected the body to fit, got %v", err)
+			}
+			if !test.ok && err != errMessageTooLarge {
+				t.Fatalf("Expected errMessageTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		headers []header
+		first   string
+		hasBody bool
+	}{
+		{
+			name:    "simple",
+			chunks:  []string{"From: a@b\r\nSubject: Hi\r\n\r\n"},
+			headers: []header{{"From", "a@b", "From: a@b"}, {"Subject", "Hi", "Subject: Hi"}},
+			hasBody: true,
+		},
+		{
+			name:    "folded",
+			chunks:  []string{"Subject: Hello\r\n  there\r\n\tworld\r\nTo: c@d\r\n\r\n"},
+			headers: []header{{"Subject", "Hello  there\tworld", "Subject: Hello\r\n  there\r\n\tworld"}, {"To", "c@d", "To: c@d"}},
+			hasBody: true,
+		},
+		{
+			name:    "folded across reads",
+			chunks:  []string{"Subject: Hello\r", "\n", " there\r\n", "\r\n"},
+			headers: []header{{"Subject", "Hello there", "Subject: Hello\r\n there"}},
+			hasBody: true,
+		},
+		{
+			name:    "no space after colon",
+			chunks:  []string{"Subject:Hi\r\nX-Empty:\r\n\r\n"},
+			headers: []header{{"Subject", "Hi", "Subject:Hi"}, {"X-Empty", "", "X-Empty:"}},
+			hasBody: true,
+		},
+		{
+			name:    "bare LF",
+			chunks:  []string{"Subject: Hi\n\n"},
+			headers: []header{{"Subject", "Hi", "Subject: Hi"}},
+			hasBody: true,
+		},
+		{
+			name:    "no body",
+			chunks:  []string{"Subject: Hi\r\n.\r\n"},
+			headers: []header{{"Subject", "Hi", "Subject: Hi"}},
+		},
+		{
+			name:    "empty data",
+			chunks:  []string{".\r\n"},
+			headers: nil,
+		},
+		{
+			name:    "body without header block",
+			chunks:  []string{"Hello there\r\n"},
+			first:   "Hello there\r\n",
+			hasBody: true,
+		},
+		{
+			name:    "starting with a folded line",
+			chunks:  []string{" Hello\r\nSubject: Hi\r\n\r\n"},
+			first:   " Hello\r\n",
+			hasBody: true,
+		},
+		{
+			name:    "body without blank line",
+			chunks:  []string{"Subject: Hi\r\n", "Hello there\n"},
+			headers: []header{{"Subject", "Hi", "Subject: Hi"}},
+			first:   "Hello there\n",
+			hasBody: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := pipeConnection(t, &Server{}, test.chunks...)
+			m := &message{}
+			first, hasBody, err := c.readHeaders(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if first != test.first || hasBody != test.hasBody {
+				t.Fatalf("Expected %q, %v, got %q, %v", test.first, test.hasBody, first, hasBody)
+			}
+
+			if len(m.atmHeaders) != len(test.headers) {
+				t.Fatalf("Expected headers %q, got %q", test.headers, m.atmHeaders)
+			}
+			for i, h := range test.headers {
+				if m.atmHeaders[i] != h {
+					t.Fatalf("Expected header %q, got %q", h, m.atmHeaders[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadHeadersTooLarge(t *testing.T) {
+	c := pipeConnection(t, &Server{MaxHeaders: 2}, "A: 1\r\nB: 2\r\nC: 3\r\n\r\n")
+	_, _, err := c.readHeaders(&message{})
+	if err != errHeaderTooLarge {
+		t.Fatalf("Expected errHeaderTooLarge for too many headers, got %v", err)
+	}
+
+	c = pipeConnection(t, &Server{MaxHeaderSize: 20}, "Subject: 1234567890\r\n", "To: a@b\r\n\r\n")
+	_, _, err = c.readHeaders(&message{})
+	if err != errHeaderTooLarge {
+		t.Fatalf("Expected errHeaderTooLarge for too large a header block, got %v", err)
+	}
+
+	// A single line is stopped before it is read in full
+	c = pipeConnection(t, &Server{MaxHeaderSize: 20}, "Subject: "+strings.Repeat("x", 100000))
+	_, _, err = c.readHeaders(&message{})
+	if err != errHeaderTooLarge {
+		t.Fatalf("Expected errHeaderTooLarge for too long a line, got %v", err)
+	}
+}
+
+func TestReadLineUsesBufferedLines(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	// Nothing more is sent, so reading from the connection again would
+	// block until the test times out
+	go io.WriteString(client, "MAIL FROM:<a@b>\r\nRCPT TO:<c@d>\r\n")
+
+	c := &connection{server: &Server{Logger: discardLogger{}}, conn: server, ctx: context.Background()}
+	c.r = bufio.NewReader(connReader{c})
+	done := make(chan []string)
+	go func() {
+		var lines []string
+		for i := 0; i < 2; i++ {
+			line, err := c.readLine()
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		done <- lines
+	}()
+
+	select {
+	case lines := <-done:
+		if strings.Join(lines, "|") != "MAIL FROM:<a@b>|RCPT TO:<c@d>" {
+			t.Fatalf("Expected both commands, got %q", lines)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Reading the second command waited for more data")
+	}
+}
+
+// heapInUse returns how many bytes are allocated on the heap once
+// garbage has been collected.
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestLongSessionMemory(t *testing.T) {
+	tc, _ := pipeSession(t, &Server{MaxLineLength: 512})
+	tc.expect(220)
+	tc.cmd("EHLO client.example.com", 250)
+
+	// Replies are read as they come so the session never waits on
+	// them
+	const commands = 20000
+	line := "NOOP " + strings.Repeat("x", 500) + "\r\n"
+	replies := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2*commands; i++ {
+			_, err := tc.r.ReadString('\n')
+			if err != nil {
+				replies <- err
+				return
+			}
+		}
+		replies <- nil
+	}()
+
+	send := func() {
+		batch := strings.Repeat(line, 100)
+		for i := 0; i < commands/100; i++ {
+			_, err := io.WriteString(tc.conn, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	send()
+	before := heapInUse()
+	// Ten megabytes more commands, that the session must not hold on
+	// to
+	send()
+	after := heapInUse()
+
+	err := <-replies
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after > before && after-before > 1<<20 {
+		t.Fatalf("Heap grew by %d bytes over %d commands", after-before, commands)
+	}
+}
+
+func BenchmarkPipelinedCommands(b *testing.B) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := &connection{server: &Server{Hostname: "example.org", Logger: discardLogger{}}, conn: server, id: 1}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.handle(context.Background())
+	}()
+	go io.Copy(io.Discard, client)
+
+	batch := strings.Repeat("NOOP\r\n", 100)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := io.WriteString(client, batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	io.WriteString(client, "QUIT\r\n")
+	<-done
+}
+
+// dotStuff is what a client sends for body with DATA: a period added
+// to every line starting with one, and the closing period.
+func dotStuff(body string) string {
+	stuffed := strings.Replace(body, "\n.", "\n..", -1)
+	if strings.HasPrefix(stuffed, ".") {
+		stuffed = "." + stuffed
+	}
+
+	return stuffed + "\r\n.\r\n"
+}
+
+func TestReadToEndOfBodyRoundTrip(t *testing.T) {
+	tokens := []string{"x", "yz", ".", "..", "\r\n", "\r\n", "\n", "\r", " ", "\r\n.", ".\r\n"}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		var body strings.Builder
+		for n := random.Intn(30); n > 0; n-- {
+			body.WriteString(tokens[random.Intn(len(tokens))])
+		}
+
+		// Split what is sent at random, so line endings and the
+		// closing period land across reads
+		sent := dotStuff(body.String())
+		var chunks []string
+		for sent != "" {
+			n := 1 + random.Intn(len(sent))
+			chunks = append(chunks, sent[:n])
+			sent = sent[n:]
+		}
+
+		c := pipeConnection(t, &Server{}, chunks...)
+		got, err := c.readToEndOfBody("", 1<<20)
+		if err != nil {
+			t.Fatalf("%q: %s", chunks, err)
+		}
+
+		if got != body.String() {
+			t.Fatalf("Sent %q, expected %q, got %q", chunks, body.String(), got)
+		}
+	}
+}
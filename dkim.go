@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimMaxSignatures is how many DKIM-Signature headers of one message
+// are verified at most, each costs a DNS lookup.
+const dkimMaxSignatures = 5
+
+// dkimResult is the outcome of verifying one DKIM-Signature, RFC 6376
+// section 6.1, named as in RFC 8601 section 2.7.1.
+type dkimResult struct {
+	result   string
+	domain   string
+	selector string
+	// reason says why a signature didn't pass.
+	reason string
+}
+
+// errDKIMTemp marks failures that may go away if tried again later.
+var errDKIMTemp = errors.New("Temporary DNS failure")
+
+// dkimSignature is a parsed DKIM-Signature header.
+type dkimSignature struct {
+	header                 header
+	algorithm              string
+	signature              []byte
+	bodyHash               []byte
+	headerCanon, bodyCanon string
+	domain                 string
+	headers                []string
+	length                 int64
+	selector               string
+	expires                int64
+}
+
+// verifyDKIM verifies every DKIM-Signature of m, up to
+// dkimMaxSignatures, and records the results on it.
+func (c *connection) verifyDKIM(m *message) {
+	ctx, cancel := context.WithTimeout(c.ctx, defaultDNSTimeout)
+	defer cancel()
+
+	for _, h := range m.atmHeaders {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+
+		if len(m.dkim) == dkimMaxSignatures {
+			break
+		}
+
+		result := verifyDKIMSignature(ctx, c.server.resolver(), m, h)
+		c.logInfo("DKIM result for d=%s s=%s: %s %s", result.domain, result.selector, result.result, result.reason)
+		m.dkim = append(m.dkim, result)
+	}
+}
+
+func verifyDKIMSignature(ctx context.Context, resolver *net.Resolver, m *message, h header) dkimResult {
+	sig, err := parseDKIMSignature(h)
+	if err != nil {
+		return dkimResult{result: "permerror", domain: sig.domain, selector: sig.selector, reason: err.Error()}
+	}
+
+	result := dkimResult{result: "pass", domain: sig.domain, selector: sig.selector}
+	err = sig.verify(ctx, resolver, m)
+	if err == errDKIMTemp {
+		result.result, result.reason = "temperror", err.Error()
+	} else if err != nil {
+		result.result, result.reason = "fail", err.Error()
+	}
+
+	return result
+}
+
+// parseDKIMTags splits a tag-list, RFC 6376 section 3.2. Whitespace
+// inside values is dropped, it can only come from folding.
+func parseDKIMTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+
+		pieces := strings.SplitN(spec, "=", 2)
+		if len(pieces) != 2 {
+			return nil, errors.New("Malformed tag " + strings.TrimSpace(spec))
+		}
+
+		name := strings.TrimSpace(pieces[0])
+		if _, ok := tags[name]; ok {
+			return nil, errors.New("Duplicate tag " + name)
+		}
+
+		tags[name] = strings.Join(strings.Fields(pieces[1]), "")
+	}
+
+	return tags, nil
+}
+
+func parseDKIMSignature(h header) (dkimSignature, error) {
+	sig := dkimSignature{header: h, headerCanon: "simple", bodyCanon: "simple", length: -1}
+	tags, err := parseDKIMTags(h.value)
+	if err != nil {
+		return sig, err
+	}
+
+	sig.domain, sig.selector = tags["d"], tags["s"]
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return sig, errors.New("Missing required tag " + name)
+		}
+	}
+
+	if tags["v"] != "1" {
+		return sig, errors.New("Unsupported version " + tags["v"])
+	}
+
+	sig.algorithm = strings.ToLower(tags["a"])
+	switch sig.algorithm {
+	case "rsa-sha256", "ed25519-sha256":
+	default:
+		// rsa-sha1 is no longer allowed, RFC 8301 section 3.1
+		return sig, errors.New("Unsupported algorithm " + tags["a"])
+	}
+
+	sig.signature, err = base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return sig, errors.New("Malformed signature")
+	}
+
+	sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return sig, errors.New("Malformed body hash")
+	}
+
+	if c, ok := tags["c"]; ok {
+		pieces := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.headerCanon = pieces[0]
+		if len(pieces) == 2 {
+			sig.bodyCanon = pieces[1]
+		}
+	}
+	for _, canon := range []string{sig.headerCanon, sig.bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return sig, errors.New("Unsupported canonicalization " + canon)
+		}
+	}
+
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, name)
+		signsFrom = signsFrom || strings.EqualFold(name, "From")
+	}
+	if !signsFrom {
+		return sig, errors.New("From is not signed")
+	}
+
+	if l, ok := tags["l"]; ok {
+		sig.length, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || sig.length < 0 {
+			return sig, errors.New("Malformed body length")
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		sig.expires, err = strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return sig, errors.New("Malformed expiry")
+		}
+	}
+
+	if q, ok := tags["q"]; ok && q != "dns/txt" {
+		return sig, errors.New("Unsupported query method " + q)
+	}
+
+	return sig, nil
+}
+
+func (sig dkimSignature) verify(ctx context.Context, resolver *net.Resolver, m *message) error {
+	if sig.expires > 0 && time.Now().Unix() > sig.expires {
+		return errors.New("Signature expired")
+	}
+
+	body := canonicalizeBody(m.body+"\r\n", sig.bodyCanon)
+	if sig.length >= 0 {
+		if sig.length > int64(len(body)) {
+			return errors.New("Body is shorter than signed length")
+		}
+
+		body = body[:sig.length]
+	}
+
+	h := sha256.New()
+	h.Write([]byte(body))
+	if !bytes.Equal(h.Sum(nil), sig.bodyHash) {
+		return errors.New("Body hash did not verify")
+	}
+
+	key, err := lookupDKIMKey(ctx, resolver, sig)
+	if err != nil {
+		return err
+	}
+
+	h.Reset()
+	h.Write([]byte(sig.signedHeaders(m)))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig.signature)
+		if err != nil {
+			return errors.New("Signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig.signature) {
+			return errors.New("Signature did not verify")
+		}
+	}
+
+	return nil
+}
+
+// signedHeaders is the header data the signature is over, RFC 6376
+// section 5.4.2: the headers listed in h, taking repeated names from
+// the bottom up, then the signature itself without its b= value.
+func (sig dkimSignature) signedHeaders(m *message) string {
+	used := map[int]bool{}
+	var b strings.Builder
+	for _, name := range sig.headers {
+		name = strings.TrimSpace(name)
+		for i := len(m.atmHeaders) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(m.atmHeaders[i].name, name) {
+				continue
+			}
+
+			used[i] = true
+			b.WriteString(canonicalizeHeader(m.atmHeaders[i].raw, sig.headerCanon) + "\r\n")
+			break
+		}
+	}
+
+	b.WriteString(canonicalizeHeader(stripDKIMSignature(sig.header.raw), sig.headerCanon))
+	return b.String()
+}
+
+// stripDKIMSignature empties the b= tag of a raw DKIM-Signature
+// header, leaving everything else as it was.
+func stripDKIMSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	start := colon + 1
+	for start < len(raw) {
+		end := strings.IndexByte(raw[start:], ';')
+		if end < 0 {
+			end = len(raw)
+		} else {
+			end += start
+		}
+
+		spec := raw[start:end]
+		if eq := strings.IndexByte(spec, '='); eq >= 0 && strings.TrimSpace(spec[:eq]) == "b" {
+			return raw[:start+eq+1] + raw[end:]
+		}
+
+		start = end + 1
+	}
+
+	return raw
+}
+
+// canonicalizeHeader canonicalizes one raw header field, without its
+// line ending, RFC 6376 section 3.4.
+func canonicalizeHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+
+	colon := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimSpace(raw[:colon]))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(raw[colon+1:])
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// canonicalizeBody canonicalizes a body ending in CRLF, RFC 6376
+// section 3.4.
+func canonicalizeBody(body, canon string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	// The last element is what followed the final line break
+	lines = lines[:len(lines)-1]
+
+	if canon == "relaxed" {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(strings.Join(strings.FieldsFunc(line, isWSP), " "), " ")
+			if len(line) > 0 && isWSP(rune(line[0])) && lines[i] != "" {
+				lines[i] = " " + lines[i]
+			}
+		}
+	}
+
+	// Trailing empty lines are ignored
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if canon == "relaxed" {
+			return ""
+		}
+
+		return "\r\n"
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// lookupDKIMKey fetches the public key sig was made with, RFC 6376
+// section 3.6.2.
+func lookupDKIMKey(ctx context.Context, resolver *net.Resolver, sig dkimSignature) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, sig.selector+"._domainkey."+sig.domain)
+	if isNotFound(err) {
+		return nil, errors.New("No key for signature")
+	}
+	if err != nil {
+		return nil, errDKIMTemp
+	}
+
+	if len(txts) == 0 {
+		return nil, errors.New("No key for signature")
+	}
+
+	tags, err := parseDKIMTags(txts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("Unsupported key version " + v)
+	}
+
+	if tags["p"] == "" {
+		return nil, errors.New("Key revoked")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, errors.New("Malformed key")
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+
+	if !strings.HasPrefix(sig.algorithm, keyType+"-") {
+		return nil, errors.New("Key type does not match algorithm")
+	}
+
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("Malformed key")
+		}
+
+		return ed25519.PublicKey(data), nil
+	}
+
+	if keyType != "rsa" {
+		return nil, errors.New("Unsupported key type " + keyType)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		// Some publish the bare RSAPublicKey
+		key, err = x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, errors.New("Malformed key")
+		}
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Key type does not match algorithm")
+	}
+
+	// RFC 8301 section 3.2
+	if rsaKey.N.BitLen() < 1024 {
+		return nil, errors.New("Key is too short")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errBadDSNParam = errors.New("Malformed DSN parameter")
+
+// dsnRecipient has the DSN parameters of RCPT, RFC 3461 section 4.
+type dsnRecipient struct {
+	// notify is NEVER alone, or any of SUCCESS, FAILURE and DELAY. It
+	// is empty if the client didn't say, which means FAILURE and DELAY.
+	notify []string
+	// orcpt is the original recipient, e.g. "rfc822;user@example.org",
+	// with its xtext decoded.
+	orcpt string
+}
+
+// notifies reports whether the client asked to be told about event,
+// one of SUCCESS, FAILURE and DELAY.
+func (d dsnRecipient) notifies(event string) bool {
+	if len(d.notify) == 0 {
+		return event == "FAILURE" || event == "DELAY"
+	}
+
+	for _, n := range d.notify {
+		if n == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDSNMail reads the RET and ENVID parameters of MAIL, RFC 3461
+// sections 4.3 and 4.4.
+func parseDSNMail(params map[string]string) (ret, envID string, err error) {
+	if v, ok := params["RET"]; ok {
+		ret = strings.ToUpper(v)
+		if ret != "FULL" && ret != "HDRS" {
+			return "", "", errBadDSNParam
+		}
+	}
+
+	if v, ok := params["ENVID"]; ok {
+		envID, err = decodeXtext(v)
+		if err != nil || envID == "" || len(v) > 100 {
+			return "", "", errBadDSNParam
+		}
+	}
+
+	return ret, envID, nil
+}
+
+// parseDSNRcpt reads the NOTIFY and ORCPT parameters of RCPT, RFC 3461
+// sections 4.1 and 4.2.
+func parseDSNRcpt(params map[string]string) (dsnRecipient, error) {
+	var d dsnRecipient
+	if v, ok := params["NOTIFY"]; ok {
+		for _, n := range strings.Split(strings.ToUpper(v), ",") {
+			switch n {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if strings.Contains(v, ",") {
+					return d, errBadDSNParam
+				}
+			default:
+				return d, errBadDSNParam
+			}
+
+			d.notify = append(d.notify, n)
+		}
+	}
+
+	if v, ok := params["ORCPT"]; ok {
+		semi := strings.IndexByte(v, ';')
+		if semi <= 0 {
+			return d, errBadDSNParam
+		}
+
+		addr, err := decodeXtext(v[semi+1:])
+		if err != nil || addr == "" {
+			return d, errBadDSNParam
+		}
+
+		d.orcpt = v[:semi] + ";" + addr
+	}
+
+	return d, nil
+}
+
+// decodeXtext undoes the xtext encoding of DSN parameters, where any
+// character may be written as + and two uppercase hex digits, RFC 3461
+// section 4. Encoded line breaks are refused, they would let a value
+// inject fields where it is written out, e.g. in a bounce.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] < '!' || s[i] > '~' || s[i] == '=' {
+			return "", errBadDSNParam
+		}
+
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+			return "", errBadDSNParam
+		}
+
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errBadDSNParam
+		}
+
+		if n == '\r' || n == '\n' {
+			return "", errBadDSNParam
+		}
+
+		b.WriteByte(byte(n))
+		i += 2
+	}
+
+	return b.String(), nil
+}
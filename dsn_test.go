@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePathParameters(t *testing.T) {
+	tests := []struct {
+		value  string
+		addr   string
+		params map[string]string
+	}{
+		{"<bob@example.org>", "bob@example.org", map[string]string{}},
+		{" <bob@example.org>  NOTIFY=SUCCESS,FAILURE", "bob@example.org", map[string]string{"NOTIFY": "SUCCESS,FAILURE"}},
+		{"<bob@example.org> notify=NEVER ORCPT=rfc822;bob+40example.org", "bob@example.org",
+			map[string]string{"NOTIFY": "NEVER", "ORCPT": "rfc822;bob+40example.org"}},
+		{"<alice@example.com> RET=HDRS ENVID=QQ314159 SMTPUTF8", "alice@example.com",
+			map[string]string{"RET": "HDRS", "ENVID": "QQ314159", "SMTPUTF8": ""}},
+		{"<> RET=FULL", "", map[string]string{"RET": "FULL"}},
+	}
+
+	for _, test := range tests {
+		addr, params := parsePath(test.value)
+		if addr != test.addr {
+			t.Errorf("%q: expected address %q, got %q", test.value, test.addr, addr)
+		}
+
+		if len(params) != len(test.params) {
+			t.Errorf("%q: expected parameters %q, got %q", test.value, test.params, params)
+			continue
+		}
+		for k, v := range test.params {
+			if got, ok := params[k]; !ok || got != v {
+				t.Errorf("%q: expected %s=%q, got %q", test.value, k, v, got)
+			}
+		}
+	}
+}
+
+func TestParseDSNMail(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		ret    string
+		envID  string
+		ok     bool
+	}{
+		{map[string]string{}, "", "", true},
+		{map[string]string{"RET": "hdrs"}, "HDRS", "", true},
+		{map[string]string{"RET": "FULL", "ENVID": "QQ+2B314159"}, "FULL", "QQ+314159", true},
+		{map[string]string{"RET": "SOME"}, "", "", false},
+		{map[string]string{"ENVID": ""}, "", "", false},
+		{map[string]string{"ENVID": "a+0Db"}, "", "", false},
+		{map[string]string{"ENVID": strings.Repeat("x", 101)}, "", "", false},
+	}
+
+	for _, test := range tests {
+		ret, envID, err := parseDSNMail(test.params)
+		if (err == nil) != test.ok || ret != test.ret || envID != test.envID {
+			t.Errorf("%q: expected %q, %q, ok %v, got %q, %q, %v", test.params, test.ret, test.envID, test.ok, ret, envID, err)
+		}
+	}
+}
+
+func TestParseDSNRcpt(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		notify string
+		orcpt  string
+		ok     bool
+	}{
+		{map[string]string{}, "", "", true},
+		{map[string]string{"NOTIFY": "success,DELAY"}, "SUCCESS,DELAY", "", true},
+		{map[string]string{"NOTIFY": "NEVER"}, "NEVER", "", true},
+		{map[string]string{"ORCPT": "rfc822;bob+40example.org"}, "", "rfc822;bob@example.org", true},
+		{map[string]string{"NOTIFY": "NEVER,SUCCESS"}, "", "", false},
+		{map[string]string{"NOTIFY": "ALWAYS"}, "", "", false},
+		{map[string]string{"NOTIFY": ""}, "", "", false},
+		{map[string]string{"ORCPT": "bob@example.org"}, "", "", false},
+		{map[string]string{"ORCPT": "rfc822;"}, "", "", false},
+		{map[string]string{"ORCPT": "rfc822;bob+0D+0ABcc:+20x@example.org"}, "", "", false},
+	}
+
+	for _, test := range tests {
+		d, err := parseDSNRcpt(test.params)
+		if err != nil {
+			if test.ok {
+				t.Errorf("%q: %s", test.params, err)
+			}
+			continue
+		}
+
+		if !test.ok {
+			t.Errorf("%q: expected an error", test.params)
+			continue
+		}
+
+		if notify := strings.Join(d.notify, ","); notify != test.notify || d.orcpt != test.orcpt {
+			t.Errorf("%q: expected %q, %q, got %q, %q", test.params, test.notify, test.orcpt, notify, d.orcpt)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		s, decoded string
+		ok         bool
+	}{
+		{"plain", "plain", true},
+		{"a+2Bb", "a+b", true},
+		{"+40+20", "@ ", true},
+		{"a+2bb", "", false},
+		{"a+2", "", false},
+		{"a+", "", false},
+		{"a b", "", false},
+		{"a=b", "", false},
+		{"a+0Ab", "", false},
+		{"a+0Db", "", false},
+	}
+
+	for _, test := range tests {
+		decoded, err := decodeXtext(test.s)
+		if (err == nil) != test.ok || decoded != test.decoded {
+			t.Errorf("%q: expected %q, ok %v, got %q, %v", test.s, test.decoded, test.ok, decoded, err)
+		}
+	}
+}
+
+func TestDSNSession(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc, extensions := ehlo(t, addr)
+	if !containsLine(extensions, "DSN") {
+		t.Fatalf("Expected DSN to be advertised, got %q", extensions)
+	}
+
+	tc.cmd("MAIL FROM:<alice@example.com> RET=SOME", 501)
+	tc.cmd("MAIL FROM:<alice@example.com> RET=HDRS ENVID=QQ314159", 250)
+	tc.cmd("RCPT TO:<bob@example.org> NOTIFY=BOGUS", 501)
+	tc.cmd("RCPT TO:<bob@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob+40example.org", 250)
+	tc.cmd("RCPT TO:<carol@example.org>", 250)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if m.envelopeFrom != "alice@example.com" || strings.Join(m.envelopeTo, ",") != "bob@example.org,carol@example.org" {
+		t.Fatalf("Expected the parameters to be left out of the envelope, got %q to %q", m.envelopeFrom, m.envelopeTo)
+	}
+	if m.dsnRet != "HDRS" || m.dsnEnvID != "QQ314159" || len(m.dsn) != 2 {
+		t.Fatalf("Unexpected DSN parameters %q, %q, %v", m.dsnRet, m.dsnEnvID, m.dsn)
+	}
+	if !m.dsn[0].notifies("SUCCESS") || m.dsn[0].notifies("DELAY") || m.dsn[0].orcpt != "rfc822;bob@example.org" {
+		t.Fatalf("Unexpected DSN parameters for the first recipient %v", m.dsn[0])
+	}
+	if m.dsn[1].notifies("SUCCESS") || !m.dsn[1].notifies("DELAY") || m.dsn[1].orcpt != "" {
+		t.Fatalf("Unexpected DSN parameters for the second recipient %v", m.dsn[1])
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EMLDir is a MessageHandler that writes every message into its own
+// .eml file in Dir, byte for byte as it would be passed on, which is
+// handy for seeing what clients actually send.
+type EMLDir struct {
+	Dir string
+}
+
+// NewEMLDir creates dir if it doesn't exist yet.
+func NewEMLDir(dir string) (*EMLDir, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EMLDir{Dir: dir}, nil
+}
+
+// Handle writes m to a file named after the time it arrived and its ID,
+// so the files sort in the order they were received.
+func (e *EMLDir) Handle(ctx context.Context, m *message) error {
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + m.id + ".eml"
+	path := filepath.Join(e.Dir, name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	// content keeps the header block as it was received, in order and
+	// with duplicates, only with our own trace headers on top
+	_, err = f.Write(m.content())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultGreylistExpiry = 36 * 24 * time.Hour
+
+// GreylistEntry is what a Greylist remembers about one triplet of
+// client address, sender and recipient.
+type GreylistEntry struct {
+	// First is when the triplet was first tried.
+	First time.Time
+	// Passed is set once the triplet was retried after the delay.
+	Passed bool
+	// Expires is when the entry should be forgotten.
+	Expires time.Time
+}
+
+// GreylistStore keeps greylist entries, e.g. in memory or in a database
+// shared by several servers.
+type GreylistStore interface {
+	Get(key string) (GreylistEntry, bool, error)
+	Put(key string, entry GreylistEntry) error
+}
+
+// Greylist temporarily refuses recipients the first time they are
+// tried from a given client address and sender. Real mail servers
+// retry and get through after Delay, a lot of spam software doesn't.
+type Greylist struct {
+	// Delay is how long a client has to wait before retrying.
+	Delay time.Duration
+	// Expiry is how long a triplet is remembered after it was last
+	// seen. It defaults to 36 days.
+	Expiry time.Duration
+	// Store keeps the entries. It defaults to a MemoryGreylistStore.
+	Store GreylistStore
+
+	once sync.Once
+}
+
+func (g *Greylist) store() GreylistStore {
+	g.once.Do(func() {
+		if g.Store == nil {
+			g.Store = &MemoryGreylistStore{}
+		}
+	})
+
+	return g.Store
+}
+
+// allow records an attempt to deliver from sender to recipient by the
+// client at ip, and reports whether it may go ahead.
+func (g *Greylist) allow(ip, sender, recipient string, now time.Time) (bool, error) {
+	expiry := g.Expiry
+	if expiry <= 0 {
+		expiry = defaultGreylistExpiry
+	}
+
+	key := ip + "\x00" + sender + "\x00" + recipient
+	entry, ok, err := g.store().Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok || now.After(entry.Expires) {
+		entry = GreylistEntry{First: now}
+	} else if !entry.Passed && now.Sub(entry.First) >= g.Delay {
+		entry.Passed = true
+	}
+
+	entry.Expires = now.Add(expiry)
+	err = g.store().Put(key, entry)
+	if err != nil {
+		return false, err
+	}
+
+	return entry.Passed, nil
+}
+
+// MemoryGreylistStore is a GreylistStore that forgets everything when
+// the server stops.
+type MemoryGreylistStore struct {
+	mu        sync.Mutex
+	entries   map[string]GreylistEntry
+	lastSweep time.Time
+}
+
+func (s *MemoryGreylistStore) Get(key string) (GreylistEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	return entry, ok, nil
+}
+
+func (s *MemoryGreylistStore) Put(key string, entry GreylistEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil {
+		s.entries = map[string]GreylistEntry{}
+	}
+
+	// Expired entries are dropped now and then so the map doesn't
+	// grow forever
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= time.Hour {
+		for k, e := range s.entries {
+			if now.After(e.Expires) {
+				delete(s.entries, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	s.entries[key] = entry
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreylistAllow(t *testing.T) {
+	g := &Greylist{Delay: 5 * time.Minute, Expiry: 24 * time.Hour}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name      string
+		ip        string
+		sender    string
+		recipient string
+		after     time.Duration
+		allowed   bool
+	}{
+		{"first attempt", "192.0.2.1", "alice@example.com", "bob@example.org", 0, false},
+		{"retry too soon", "192.0.2.1", "alice@example.com", "bob@example.org", time.Minute, false},
+		{"retry after the delay", "192.0.2.1", "alice@example.com", "bob@example.org", 5 * time.Minute, true},
+		{"later on", "192.0.2.1", "alice@example.com", "bob@example.org", time.Hour, true},
+		{"another recipient", "192.0.2.1", "alice@example.com", "carol@example.org", time.Hour, false},
+		{"another sender", "192.0.2.1", "dave@example.com", "bob@example.org", time.Hour, false},
+		{"another address", "192.0.2.2", "alice@example.com", "bob@example.org", time.Hour, false},
+		// Still remembered, since it was last seen an hour in
+		{"before expiry", "192.0.2.1", "alice@example.com", "bob@example.org", 24 * time.Hour, true},
+		{"after expiry", "192.0.2.1", "alice@example.com", "bob@example.org", 49 * time.Hour, false},
+		{"retry after expiry", "192.0.2.1", "alice@example.com", "bob@example.org", 49*time.Hour + 5*time.Minute, true},
+	}
+
+	for _, step := range steps {
+		allowed, err := g.allow(step.ip, step.sender, step.recipient, start.Add(step.after))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed != step.allowed {
+			t.Fatalf("%s: expected allowed to be %v", step.name, step.allowed)
+		}
+	}
+}
+
+func TestGreylistSession(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h, Greylist: &Greylist{Delay: 100 * time.Millisecond}}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 450)
+	tc.cmd("RCPT TO:<bob@example.org>", 450)
+	tc.cmd("DATA", 554)
+	tc.cmd("QUIT", 221)
+
+	// The client comes back later, as a real mail server would
+	time.Sleep(150 * time.Millisecond)
+	tc = connect(t, addr)
+	tc.startMail()
+	tc.cmd("RCPT TO:<carol@example.org>", 450)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 || len(msgs[0].envelopeTo) != 1 || msgs[0].envelopeTo[0] != "bob@example.org" {
+		t.Fatalf("Expected a message to bob@example.org, got %v", msgs)
+	}
+}
+
+func TestGreylistSkipsTrustedClients(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &Server{
+		Greylist:             &Greylist{Delay: time.Hour},
+		AllowList:            []*net.IPNet{loopback},
+		AllowListSkipsChecks: true,
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.cmd("QUIT", 221)
+}
+
+// failingGreylistStore is a GreylistStore that can't be reached.
+type failingGreylistStore struct{}
+
+func (failingGreylistStore) Get(key string) (GreylistEntry, bool, error) {
+	return GreylistEntry{}, false, errors.New("Store unavailable")
+}
+
+func (failingGreylistStore) Put(key string, entry GreylistEntry) error {
+	return errors.New("Store unavailable")
+}
+
+func TestGreylistStoreFailure(t *testing.T) {
+	s := &Server{Greylist: &Greylist{Store: failingGreylistStore{}}}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 451)
+	tc.cmd("QUIT", 221)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MessageHandler is given every message the server accepts, once its
+// body has been read. An error is reported to the client as a
+// temporary failure so it will retry, unless it is an *SMTPError.
+type MessageHandler interface {
+	Handle(ctx context.Context, m *message) error
+}
+
+// RecipientHandler is a MessageHandler that can deliver a message to
+// some of its recipients and fail for others. In LMTP sessions, which
+// reply once for every recipient, HandleRecipients is called instead of
+// Handle. SMTP sessions only have one reply for the whole message and
+// still call Handle.
+type RecipientHandler interface {
+	MessageHandler
+	HandleRecipients(ctx context.Context, m *message) []RecipientResult
+}
+
+// RecipientResult is the outcome of delivering a message to one of its
+// recipients.
+type RecipientResult struct {
+	Recipient string
+	// Err is nil if the message was delivered to Recipient. Like an
+	// error returned by Handle it is reported as a temporary failure,
+	// unless it is an *SMTPError.
+	Err error
+}
+
+// Deliverer stores a message for one recipient, such as in their
+// mailbox, see PerRecipient.
+type Deliverer interface {
+	Deliver(recipient string, m *message) error
+}
+
+// DeliverFunc lets an ordinary function be a Deliverer.
+type DeliverFunc func(recipient string, m *message) error
+
+func (f DeliverFunc) Deliver(recipient string, m *message) error {
+	return f(recipient, m)
+}
+
+// PerRecipient is a RecipientHandler giving every message to Deliverer
+// once for each of its recipients, in order. LMTP clients learn how it
+// went for each of them. SMTP only has one reply for the message: if it
+// failed for everyone it gets the reply for the first failure, and if
+// it only failed for some, the sender is sent a bounce for them through
+// Bounces. Without Bounces the message gets a temporary failure
+// instead, since delivering it twice to the rest is better than losing
+// it, RFC 5321 section 6.1.
+type PerRecipient struct {
+	Deliverer Deliverer
+	// Bounces, if set, is given the bounces for recipients that failed
+	// when others didn't.
+	Bounces MessageHandler
+	// Hostname is the sender of bounces. It defaults to localhost.
+	Hostname string
+	// Logger receives the failures that were bounced. It defaults to a
+	// TextLogger at LevelInfo.
+	Logger Logger
+}
+
+func (p PerRecipient) HandleRecipients(ctx context.Context, m *message) []RecipientResult {
+	results := make([]RecipientResult, len(m.envelopeTo))
+	for i, to := range m.envelopeTo {
+		results[i].Recipient = to
+		// Recipients not reached before the session ends are left
+		// for the client to retry
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		results[i].Err = p.Deliverer.Deliver(to, m)
+	}
+
+	return results
+}
+
+func (p PerRecipient) Handle(ctx context.Context, m *message) error {
+	var failed []RecipientResult
+	results := p.HandleRecipients(ctx, m)
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	if len(failed) == len(results) {
+		return failed[0].Err
+	}
+
+	if p.Bounces == nil {
+		return &SMTPError{Code: 451, Message: "4.3.0 Delivery failed for some recipients"}
+	}
+
+	logger := p.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+
+	hostname := p.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	var bounced []bounceFailure
+	for _, result := range failed {
+		logger.Log(LevelError, fmt.Sprintf("Failed to deliver message %s to %s: %s", m.id, result.Recipient, result.Err), Field{Key: FieldMessageID, Value: m.id})
+
+		reply := "550 5.3.0 Local delivery failed"
+		var smtpErr *SMTPError
+		if errors.As(result.Err, &smtpErr) {
+			reply = smtpErr.Error()
+		}
+		bounced = append(bounced, bounceFailure{recipient: result.Recipient, reply: reply})
+	}
+
+	// The rest of the recipients already have the message, so failing
+	// it would have it delivered to them again on a retry
+	if bounce, ok := newBounce(hostname, "", m, bounced); ok {
+		err := p.Bounces.Handle(ctx, bounce)
+		if err != nil {
+			logger.Log(LevelError, fmt.Sprintf("Failed to send bounce for message %s: %s", m.id, err), Field{Key: FieldMessageID, Value: m.id})
+		}
+	}
+
+	return nil
+}
+
+// SMTPError is an error carrying the reply the client should get for
+// it.
+type SMTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// logHandler is the default MessageHandler. It only logs the envelope.
+type logHandler struct {
+	logger Logger
+}
+
+func (h logHandler) Handle(ctx context.Context, m *message) error {
+	h.logger.Log(LevelInfo, fmt.Sprintf("Received message %s from <%s> for %s (%d bytes)", m.id, m.envelopeFrom, strings.Join(m.envelopeTo, ", "), len(m.body)))
+	return nil
+}
+
+// bytes serializes m as an RFC 5322 message with CRLF line endings,
+// prefixed with headers recording its envelope, for final delivery.
+func (m *message) bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", m.envelopeFrom)
+	for _, to := range m.envelopeTo {
+		fmt.Fprintf(&b, "Delivered-To: %s\r\n", to)
+	}
+
+	b.Write(m.content())
+	return b.Bytes()
+}
+
+// content serializes m as an RFC 5322 message with CRLF line endings,
+// the way it is passed on to another server.
+func (m *message) content() []byte {
+	var b bytes.Buffer
+	for _, h := range m.atmHeaders {
+		b.WriteString(h.raw + "\r\n")
+	}
+
+	b.WriteString("\r\n")
+	b.WriteString(m.body)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthHandler serves /healthz and /readyz, for orchestrators such as
+// Kubernetes. /healthz succeeds while the server is serving, draining
+// included, and /readyz only while it is also accepting connections,
+// so clients are sent elsewhere during a graceful shutdown.
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, atomic.LoadInt32(&s.serving) > 0, "not serving")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if s.shuttingDown() {
+			writeHealth(w, false, "draining")
+			return
+		}
+
+		writeHealth(w, atomic.LoadInt32(&s.serving) > 0, "not serving")
+	})
+
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, reason string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(reason + "\n"))
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
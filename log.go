@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log event is.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// parseLevel reads a level named as by String, in any case.
+func parseLevel(s string) (Level, error) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelError} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, errors.New("Unknown log level: " + s)
+}
+
+// Field is a piece of context attached to a log event, such as the
+// connection id or the command being handled.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Field keys the server attaches to events.
+const (
+	FieldConnID     = "conn"
+	FieldRemoteAddr = "remote"
+	FieldCommand    = "command"
+	FieldCode       = "code"
+	FieldMessageID  = "message_id"
+)
+
+// Logger receives every event the server logs. It must be safe to call
+// from multiple goroutines.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// TextLogger writes events through the standard log package as
+// "[LEVEL] [conn: remote] message". Other fields are left out so the
+// output reads the same as it always has. Events below MinLevel are
+// dropped.
+type TextLogger struct {
+	MinLevel Level
+}
+
+func (l TextLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.MinLevel {
+		return
+	}
+
+	var id, remote interface{}
+	for _, f := range fields {
+		switch f.Key {
+		case FieldConnID:
+			id = f.Value
+		case FieldRemoteAddr:
+			remote = f.Value
+		}
+	}
+
+	if id != nil {
+		log.Printf("[%s] [%v: %v] %s\n", level, id, remote, msg)
+		return
+	}
+
+	log.Printf("[%s] %s\n", level, msg)
+}
+
+// maxJSONLogMessage is how much of a message JSONLogger writes, so whole
+// message bodies don't end up in a log pipeline.
+const maxJSONLogMessage = 4096
+
+// JSONLogger writes every event as a JSON object on a line of its own,
+// with "time", "level" and "msg" keys followed by the event's fields.
+// Messages longer than maxJSONLogMessage are cut short. Events below
+// MinLevel are dropped.
+type JSONLogger struct {
+	// Writer defaults to os.Stderr, like the standard log package.
+	Writer   io.Writer
+	MinLevel Level
+
+	mu sync.Mutex
+}
+
+func (l *JSONLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.MinLevel {
+		return
+	}
+
+	if len(msg) > maxJSONLogMessage {
+		msg = fmt.Sprintf("%s... (%d bytes truncated)", msg[:maxJSONLogMessage], len(msg)-maxJSONLogMessage)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSON(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, msg)
+	for _, f := range fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.Key)
+		b.WriteByte(':')
+		value := f.Value
+		// Most errors have no exported fields to marshal
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJSON(&b, value)
+	}
+	b.WriteString("}\n")
+
+	w := l.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w.Write(b.Bytes())
+}
+
+// writeJSON appends v to b, leaving characters like < and > in
+// addresses as they are.
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	var encoded bytes.Buffer
+	enc := json.NewEncoder(&encoded)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		encoded.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+
+	b.Write(bytes.TrimSuffix(encoded.Bytes(), []byte{'\n'}))
+}
+
+// defaultLogger is used until a Server is configured, and by servers
+// without a Logger.
+var defaultLogger Logger = TextLogger{MinLevel: LevelInfo}
+
+func logError(err error) {
+	defaultLogger.Log(LevelError, err.Error())
+}
+
+func logInfo(msg string) {
+	defaultLogger.Log(LevelInfo, msg)
+}
+
+func (s *Server) logger() Logger {
+	if s.Logger == nil {
+		return defaultLogger
+	}
+
+	return s.Logger
+}
+
+func (s *Server) logInfo(msg string) {
+	s.logger().Log(LevelInfo, msg)
+}
+
+func (s *Server) logError(err error) {
+	s.logger().Log(LevelError, err.Error())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Maildir is a MessageHandler that delivers into a maildir, see
+// https://cr.yp.to/proto/maildir.html.
+type Maildir struct {
+	Root string
+
+	deliveries int64
+}
+
+// NewMaildir creates the tmp, new and cur directories under root if
+// they don't exist yet.
+func NewMaildir(root string) (*Maildir, error) {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Maildir{Root: root}, nil
+}
+
+func (md *Maildir) uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	now := time.Now()
+	n := atomic.AddInt64(&md.deliveries, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
+
+// Handle writes m into tmp and then renames it into new, so readers
+// never see a partially written message.
+func (md *Maildir) Handle(ctx context.Context, m *message) error {
+	name := md.uniqueName()
+	tmp := filepath.Join(md.Root, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Maildir messages use Unix line endings
+	_, err = f.Write(bytes.ReplaceAll(m.bytes(), []byte("\r\n"), []byte("\n")))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(md.Root, "new", name))
+}
@@ -1,284 +1,412 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"log"
+	"flag"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func logError(err error) {
-	log.Printf("[ERROR] %s\n", err)
-}
-
-func logInfo(msg string) {
-	log.Printf("[INFO] %s\n", msg)
-}
+func loadTLSConfig(certFile, keyFile string) *tls.Config {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		panic(err)
+	}
 
-type message struct {
-	clientDomain string
-	smtpCommands  map[string]string
-	atmHeaders   map[string]string
-	body         string
-	from         string
-	date         string
-	subject      string
-	to           string
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
 }
 
-type connection struct {
-	conn net.Conn
-	id   int
-	buf  []byte
-}
+// loadSNICertificates reads a comma separated list of
+// name=cert.pem:key.pem certificates.
+func loadSNICertificates(list string) (map[string]*tls.Certificate, error) {
+	certs := map[string]*tls.Certificate{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
 
-func (c *connection) logInfo(msg string, args ...interface{}) {
-	args = append([]interface{}{c.id, c.conn.RemoteAddr().String()}, args...)
-	log.Printf("[INFO] [%d: %s] "+msg+"\n", args...)
-}
+		name, files := entry, ""
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name, files = entry[:i], entry[i+1:]
+		}
 
-func (c *connection) logError(err error) {
-	log.Printf("[ERROR] [%d: %s] %s\n", c.id, c.conn.RemoteAddr().String(), err)
-}
+		pieces := strings.SplitN(files, ":", 2)
+		if name == "" || len(pieces) != 2 {
+			return nil, errors.New("Expected name=cert.pem:key.pem got: " + entry)
+		}
 
-func (c *connection) readLine() (string, error) {
-	for {
-		b := make([]byte, 1024)
-		n, err := c.conn.Read(b)
+		cert, err := tls.LoadX509KeyPair(pieces[0], pieces[1])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		c.buf = append(c.buf, b[:n]...)
-		for i, b := range c.buf {
-			// If end of line
-			if b == '\n' && i > 0 && c.buf[i-1] == '\r' {
-				// i-1 because drop the CRLF, no one cares after this
-				line := string(c.buf[:i-1])
-				c.buf = c.buf[i+1:]
-				return line, nil
-			}
-		}
+		certs[name] = &cert
 	}
-}
-
-func (c *connection) readMultiLine() (string, error) {
-	for {
-		noMoreReads := false
-		for i, b := range c.buf {
-			if i > 1 &&
-				b != ' ' &&
-				b != '\t' &&
-				c.buf[i-2] == '\r' &&
-				c.buf[i-1] == '\n' {
-				// i-2 because drop the CRLF, no one cares after this
-				line := string(c.buf[:i-2])
-				c.buf = c.buf[i:]
-				return line, nil
-			}
-
-			noMoreReads = c.isBodyClose(i)
-		}
 
-		if !noMoreReads {
-			b := make([]byte, 1024)
-			n, err := c.conn.Read(b)
-			if err != nil {
-				return "", err
-			}
+	return certs, nil
+}
 
-			c.buf = append(c.buf, b[:n]...)
+// loadCertPool reads the PEM certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-			// If this gets here more than once it's going to be an infinite loop
-		}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + path)
 	}
-}
 
-func (c *connection) isBodyClose(i int) bool {
-	return i > 4 &&
-		c.buf[i-4] == '\r' &&
-		c.buf[i-3] == '\n' &&
-		c.buf[i-2] == '.' &&
-		c.buf[i-1] == '\r' &&
-		c.buf[i-0] == '\n'
+	return pool, nil
 }
 
-func (c *connection) readToEndOfBody() (string, error) {
-	for {
-		for i := range c.buf {
-			if c.isBodyClose(i) {
-				return string(c.buf[:i-4]), nil
-			}
-		}
+// envOr returns the environment variable key, or fallback if it is
+// unset.
+func envOr(key, fallback string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
 
-		b := make([]byte, 1024)
-		n, err := c.conn.Read(b)
-		if err != nil {
-			return "", err
-		}
+	return value
+}
 
-		c.buf = append(c.buf, b[:n]...)
+func main() {
+	addr := flag.String("addr", envOr("GOMAIL_ADDR", defaultAddr), "Address to accept SMTP on, or unix:/path for a Unix socket, defaults to $GOMAIL_ADDR or :25")
+	hostname := flag.String("hostname", "", "Hostname announced to clients, defaults to the system hostname")
+	greeting := flag.String("greeting", "", "Text of the greeting after the hostname, defaults to \"ESMTP ready\"")
+	maxMessageSize := flag.Int("max-message-size", defaultMaxMessageSize, "Maximum message size in bytes, 0 for no limit")
+	maxLineLength := flag.Int("max-line-length", defaultMaxLineLength, "Maximum command line length in bytes, 0 for no limit")
+	maxRecipients := flag.Int("max-recipients", defaultMaxRecipients, "Maximum number of recipients per message, 0 for no limit")
+	maxHeaders := flag.Int("max-headers", defaultMaxHeaders, "Maximum number of header fields per message, 0 for no limit")
+	maxHeaderSize := flag.Int("max-header-size", defaultMaxHeaderSize, "Maximum header block size in bytes, 0 for no limit")
+	tlsCert := flag.String("tls-cert", "", "Path to a PEM certificate, enables STARTTLS")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM private key for -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Oldest TLS version accepted, e.g. 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "Comma separated TLS 1.2 cipher suites to accept, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, defaults to Go's")
+	tlsSNICerts := flag.String("tls-sni-certs", "", "Comma separated name=cert.pem:key.pem certificates picked by the server name clients ask for, falling back to -tls-cert and -smtps-cert")
+	smtpsAddr := flag.String("smtps-addr", "", "Address to accept implicit TLS connections on, e.g. :465")
+	smtpsCert := flag.String("smtps-cert", "", "Path to a PEM certificate for -smtps-addr, defaults to -tls-cert")
+	smtpsKey := flag.String("smtps-key", "", "Path to the PEM private key for -smtps-cert, defaults to -tls-key")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to PEM CA certificates to verify TLS client certificates with, enables AUTH EXTERNAL as the certificate's common name")
+	aliasFile := flag.String("aliases", "", "Path to a file of alias: target, target lines rewriting recipients")
+	authFile := flag.String("auth-file", "", "Path to a file of username:password lines, enables AUTH over TLS")
+	requireTLS := flag.Bool("require-tls", false, "Refuse MAIL FROM and AUTH from clients that have not issued STARTTLS")
+	synthesizeHeaders := flag.Bool("synthesize-headers", false, "Add a Date, From and Message-ID header to messages missing them, for a submission server")
+	requireAuth := flag.Bool("require-auth", false, "Refuse mail from clients that have not authenticated")
+	maxSessionDuration := flag.Duration("max-session-duration", defaultMaxSessionDuration, "Longest a session may last, 0 for no limit")
+	maxCommands := flag.Int("max-commands", defaultMaxCommands, "Maximum number of commands per session, 0 for no limit")
+	readTimeout := flag.Duration("read-timeout", defaultReadTimeout, "How long to wait on an idle client, 0 for no limit")
+	writeTimeout := flag.Duration("write-timeout", defaultWriteTimeout, "How long to wait on a client to accept a reply, 0 for no limit")
+	drainTimeout := flag.Duration("drain-timeout", defaultDrainTimeout, "How long to wait for open connections on shutdown, 0 for no limit")
+	maildir := flag.String("maildir", "", "Path to a maildir to deliver accepted messages into")
+	mbox := flag.String("mbox", "", "Path to an mbox file to append accepted messages to")
+	emlDir := flag.String("eml-dir", "", "Directory to write each accepted message into as an .eml file")
+	maxConnections := flag.Int("max-connections", 0, "Maximum number of open sessions, 0 for no limit")
+	maxConnectionsPerIP := flag.Int("max-connections-per-ip", 0, "Maximum number of open sessions from one address, 0 for no limit")
+	maxConnectionRate := flag.Int("max-connection-rate", 0, "Maximum number of new connections per minute from one address, 0 for no limit")
+	healthAddr := flag.String("health-addr", "", "Address to serve /healthz and /readyz on, e.g. :8080")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9100")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Expect a PROXY protocol header on every connection, only for use behind a trusted proxy")
+	relayAddr := flag.String("relay", "", "Address of a smarthost to relay accepted messages to, e.g. mail.example.com:587")
+	relayTLS := flag.Bool("relay-tls", false, "Connect to -relay with implicit TLS rather than STARTTLS")
+	relayRequireTLS := flag.Bool("relay-require-tls", false, "Refuse to relay to a smarthost that doesn't offer STARTTLS")
+	relayUser := flag.String("relay-user", "", "Username to authenticate to -relay with")
+	relayPassword := flag.String("relay-password", "", "Password for -relay-user, defaults to $GOMAIL_RELAY_PASSWORD")
+	relayBounce := flag.Bool("relay-bounce", false, "Accept mail -relay refuses for some recipients and send the sender a bounce through -relay")
+	relayQueue := flag.Bool("relay-queue", false, "Queue mail for -relay and retry it in the background rather than relaying during the session")
+	checkSPF := flag.Bool("spf", false, "Check the envelope sender with SPF")
+	rejectSPFFail := flag.Bool("spf-reject", false, "Refuse mail whose sender fails the SPF check, implies -spf")
+	verifyDKIM := flag.Bool("dkim", false, "Verify the DKIM signatures of received messages")
+	greylistDelay := flag.Duration("greylist", 0, "Greylist new senders, refusing them until they retry after this long, 0 to turn off")
+	greylistExpiry := flag.Duration("greylist-expiry", defaultGreylistExpiry, "How long greylisted senders are remembered")
+	localDomains := flag.String("local-domains", "", "Comma separated domains to accept mail for from anyone, defaults to -hostname")
+	relayDomains := flag.String("relay-domains", "", "Comma separated domains anyone may relay mail to")
+	allow := flag.String("allow", "", "Comma separated networks always let in, even if in -deny")
+	deny := flag.String("deny", "", "Comma separated networks to refuse connections from, e.g. 192.0.2.0/24")
+	xclientAllow := flag.String("xclient-allow", "", "Comma separated networks of trusted front-ends allowed to use XCLIENT")
+	xstatAllow := flag.String("xstat-allow", "", "Comma separated networks allowed to ask for server statistics with XSTAT")
+	allowSkipsChecks := flag.Bool("allow-skips-checks", false, "Exempt -allow networks from -max-connection-rate and -greylist")
+	tarpit := flag.Duration("tarpit", 0, "How long to hold back every error reply, to slow down abusive clients, 0 to turn off")
+	lookupRemoteHost := flag.Bool("rdns", false, "Look up the hostname of every client with reverse DNS")
+	verifyRemoteHost := flag.Bool("fcrdns", false, "Only take a client hostname that resolves back to its address, implies -rdns")
+	logLevel := flag.String("log-level", "info", "Least important events to log: debug, info or error. Message bodies are only logged at debug")
+	logFormat := flag.String("log-format", "text", "Log format, text or json")
+	lmtpAddr := flag.String("lmtp-addr", "", "Address to accept LMTP on, e.g. unix:/run/gomail/lmtp")
+	flag.Parse()
+
+	// Not a flag default, that would print the password in -h
+	passwordSet := false
+	flag.Visit(func(f *flag.Flag) {
+		passwordSet = passwordSet || f.Name == "relay-password"
+	})
+	if !passwordSet {
+		*relayPassword = os.Getenv("GOMAIL_RELAY_PASSWORD")
 	}
-}
 
-func (c *connection) writeLine(msg string) error {
-	msg += "\r\n"
-	for len(msg) > 0 {
-		n, err := c.conn.Write([]byte(msg))
-		if err != nil {
-			return err
-		}
+	minLevel, err := parseLevel(*logLevel)
+	if err != nil {
+		panic(err)
+	}
 
-		msg = msg[n:]
+	switch *logFormat {
+	case "text":
+		defaultLogger = TextLogger{MinLevel: minLevel}
+	case "json":
+		defaultLogger = &JSONLogger{MinLevel: minLevel}
+	default:
+		panic("-log-format must be text or json")
 	}
 
-	return nil
-}
+	s := &Server{
+		Addr:           *addr,
+		Logger:         defaultLogger,
+		Greeting:       *greeting,
+		LMTPAddr:       *lmtpAddr,
+		Hostname:       *hostname,
+		MaxMessageSize: *maxMessageSize,
+		MaxLineLength:  *maxLineLength,
+		MaxRecipients:  *maxRecipients,
+		MaxHeaders:     *maxHeaders,
+		MaxHeaderSize:  *maxHeaderSize,
+		RequireAuth:    *requireAuth,
+		RequireTLS:     *requireTLS,
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+		DrainTimeout:   *drainTimeout,
+
+		MaxSessionDuration: *maxSessionDuration,
+		MaxCommands:        *maxCommands,
+		SynthesizeHeaders:  *synthesizeHeaders,
+
+		MaxConnections:      *maxConnections,
+		MaxConnectionsPerIP: *maxConnectionsPerIP,
+		MaxConnectionRate:   *maxConnectionRate,
+		ProxyProtocol:       *proxyProtocol,
+		CheckSPF:            *checkSPF || *rejectSPFFail,
+		RejectSPFFail:       *rejectSPFFail,
+		VerifyDKIM:          *verifyDKIM,
+		LookupRemoteHost:    *lookupRemoteHost || *verifyRemoteHost,
+		VerifyRemoteHost:    *verifyRemoteHost,
+	}
 
-func (c *connection) handle() {
-	defer c.conn.Close()
-	c.logInfo("Connection accepted")
+	s.AllowList, err = parseCIDRList(*allow)
+	if err != nil {
+		panic(err)
+	}
 
-	err := c.writeLine("220")
+	s.DenyList, err = parseCIDRList(*deny)
 	if err != nil {
-		c.logError(err)
-		return
+		panic(err)
 	}
 
-	c.logInfo("Awaiting EHLO")
+	s.XClientAllowList, err = parseCIDRList(*xclientAllow)
+	if err != nil {
+		panic(err)
+	}
 
-	line, err := c.readLine()
+	s.XStatAllowList, err = parseCIDRList(*xstatAllow)
 	if err != nil {
-		c.logError(err)
-		return
+		panic(err)
 	}
 
-	if !strings.HasPrefix(line, "EHLO") {
-		c.logError(errors.New("Expected EHLO got: " + line))
-		return
+	s.AllowListSkipsChecks = *allowSkipsChecks
+	s.LocalDomains = parseDomainList(*localDomains)
+	s.RelayDomains = parseDomainList(*relayDomains)
+
+	if *greylistDelay > 0 {
+		s.Greylist = &Greylist{Delay: *greylistDelay, Expiry: *greylistExpiry}
 	}
 
-	msg := message{
-		smtpCommands: map[string]string{},
-		atmHeaders:  map[string]string{},
+	if *tarpit > 0 {
+		s.Tarpit = func(remoteAddr net.Addr, code int) time.Duration {
+			if code < 400 {
+				return 0
+			}
+
+			return *tarpit
+		}
 	}
-	msg.clientDomain = line[len("EHLO "):]
 
-	c.logInfo("Received EHLO")
+	if *tlsCert != "" {
+		s.TLSConfig = loadTLSConfig(*tlsCert, *tlsKey)
+	}
 
-	err = c.writeLine("250 ")
+	s.TLSMinVersion, err = parseTLSVersion(*tlsMinVersion)
 	if err != nil {
-		c.logError(err)
-		return
+		panic(err)
 	}
 
-	c.logInfo("Done EHLO")
+	s.TLSCertificates, err = loadSNICertificates(*tlsSNICerts)
+	if err != nil {
+		panic(err)
+	}
 
-	for line != "" {
-		line, err = c.readLine()
+	if *tlsCiphers != "" {
+		s.TLSCipherSuites, err = parseCipherSuites(*tlsCiphers)
 		if err != nil {
-			c.logError(err)
-			return
+			panic(err)
 		}
+	}
 
-		pieces := strings.SplitN(line, ":", 2)
-		smtpCommand := strings.ToUpper(pieces[0])
+	if *aliasFile != "" {
+		aliases, err := loadMemoryAliases(*aliasFile)
+		if err != nil {
+			panic(err)
+		}
 
-		// Special header without a value
-		if smtpCommand == "DATA" {
-			err = c.writeLine("354")
-			if err != nil {
-				c.logError(err)
-				return
-			}
+		s.AliasResolver = aliases
+	}
 
-			break
+	if *authFile != "" {
+		auth, err := loadMemoryAuthenticator(*authFile)
+		if err != nil {
+			panic(err)
 		}
 
-		smtpValue := pieces[1]
-		msg.smtpCommands[smtpCommand] = smtpValue
+		s.Authenticator = auth
+	}
+
+	if s.RequireTLS && s.TLSConfig == nil {
+		panic("-require-tls needs -tls-cert, otherwise no client could send mail")
+	}
 
-		c.logInfo("Got header: " + line)
+	if s.RequireAuth && (s.Authenticator == nil && *tlsClientCA == "" || s.TLSConfig == nil && *smtpsAddr == "") {
+		panic("-require-auth needs -auth-file or -tls-client-ca and TLS, otherwise no client could send mail")
+	}
 
-		err = c.writeLine("250 OK")
+	if *maildir != "" {
+		md, err := NewMaildir(*maildir)
 		if err != nil {
-			c.logError(err)
-			return
+			panic(err)
 		}
+
+		s.Handler = md
 	}
 
-	c.logInfo("Done SMTP headers, reading ARPA text message headers")
+	if *mbox != "" {
+		if s.Handler != nil {
+			panic("Only one of -maildir, -mbox, -eml-dir and -relay can be set")
+		}
 
-	for {
-		line, err = c.readMultiLine()
-		if err != nil {
-			c.logError(err)
-			return
+		s.Handler = &Mbox{Path: *mbox}
+	}
+
+	if *emlDir != "" {
+		if s.Handler != nil {
+			panic("Only one of -maildir, -mbox, -eml-dir and -relay can be set")
 		}
 
-		if strings.TrimSpace(line) == "" {
-			break
+		ed, err := NewEMLDir(*emlDir)
+		if err != nil {
+			panic(err)
 		}
 
-		pieces := strings.SplitN(line, ": ", 2)
-		atmHeader := strings.ToUpper(pieces[0])
-		atmValue := pieces[1]
-		msg.atmHeaders[atmHeader] = atmValue
+		s.Handler = ed
+	}
 
-		if atmHeader == "SUBJECT" {
-			msg.subject = atmValue
+	var queue *Queue
+	if *relayAddr != "" {
+		if s.Handler != nil {
+			panic("Only one of -maildir, -mbox, -eml-dir and -relay can be set")
 		}
-		if atmHeader == "TO" {
-			msg.to = atmValue
+
+		relay := &Relay{
+			Addr:        *relayAddr,
+			Hostname:    s.hostname(),
+			ImplicitTLS: *relayTLS,
+			RequireTLS:  *relayRequireTLS,
+			Username:    *relayUser,
+			Password:    *relayPassword,
 		}
-		if atmHeader == "FROM" {
-			msg.from = atmValue
+		if *relayBounce {
+			relay.Bounces = relay
 		}
-		if atmHeader == "DATE" {
-			msg.date = atmValue
+
+		s.Handler = relay
+		if *relayQueue {
+			queue = &Queue{Deliver: relay, Hostname: s.hostname()}
+			if *relayBounce {
+				relay.Bounces = queue
+			}
+
+			s.Handler = queue
 		}
 	}
 
-	c.logInfo("Done ARPA text message headers, reading body")
+	if *smtpsAddr != "" {
+		s.ImplicitTLSAddr = *smtpsAddr
+		s.ImplicitTLSConfig = s.TLSConfig
+		if *smtpsCert != "" {
+			s.ImplicitTLSConfig = loadTLSConfig(*smtpsCert, *smtpsKey)
+		}
 
-	msg.body, err = c.readToEndOfBody()
-	if err != nil {
-		c.logError(err)
-		return
+		if s.ImplicitTLSConfig == nil {
+			panic("-smtps-addr requires -smtps-cert or -tls-cert")
+		}
 	}
 
-	c.logInfo("Got body (%d bytes)", len(msg.body))
+	if *tlsClientCA != "" {
+		if s.TLSConfig == nil && s.ImplicitTLSConfig == nil {
+			panic("-tls-client-ca requires -tls-cert or -smtps-cert")
+		}
 
-	err = c.writeLine("250 OK")
-	if err != nil {
-		c.logError(err)
-		return
+		pool, err := loadCertPool(*tlsClientCA)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, config := range []*tls.Config{s.TLSConfig, s.ImplicitTLSConfig} {
+			if config != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+
+		s.ClientCertResolver = CommonNameResolver{}
 	}
 
-	c.logInfo("Message:\n%s\n", msg.body)
+	if *metricsAddr != "" || len(s.XStatAllowList) > 0 {
+		s.Metrics = &Metrics{}
+	}
 
-	c.logInfo("Connection closed")
-}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.Metrics)
+		go func() {
+			logInfo("Serving metrics on " + *metricsAddr)
+			logError(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
 
-func main() {
-	l, err := net.Listen("tcp", "0.0.0.0:25")
-	if err != nil {
-		panic(err)
+	if *healthAddr != "" {
+		go func() {
+			logInfo("Serving health checks on " + *healthAddr)
+			logError(http.ListenAndServe(*healthAddr, s.HealthHandler()))
+		}()
 	}
-	defer l.Close()
 
-	logInfo("Listening")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	id := 0
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			logError(err)
-			continue
-		}
+	if queue != nil {
+		go queue.Run(ctx)
+	}
 
-		id += 1
-		c := connection{conn, id, nil}
-		go c.handle()
+	err = s.ListenAndServe(ctx)
+	if err != nil {
+		logError(err)
 	}
+
+	logInfo("Shut down")
 }
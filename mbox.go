@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Mbox is a MessageHandler that appends every message to a single mboxrd
+// file. The file is locked during each delivery so concurrent
+// connections, or other programs honouring the lock, don't interleave.
+type Mbox struct {
+	Path string
+}
+
+var mboxFromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+func (mb *Mbox) Handle(ctx context.Context, m *message) error {
+	sender := m.envelopeFrom
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+
+	var b bytes.Buffer
+	b.WriteString("From " + sender + " " + time.Now().UTC().Format(time.ANSIC) + "\n")
+	content := bytes.ReplaceAll(m.bytes(), []byte("\r\n"), []byte("\n"))
+	b.Write(mboxFromLine.ReplaceAll(content, []byte(">$1")))
+	// Messages are separated by a blank line
+	b.WriteString("\n")
+
+	f, err := os.OpenFile(mb.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	_, err = f.Write(b.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMboxConcurrentDelivery(t *testing.T) {
+	mb := &Mbox{Path: filepath.Join(t.TempDir(), "mbox")}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		m := &message{
+			envelopeFrom: fmt.Sprintf("sender%d@example.com", i),
+			envelopeTo:   []string{"bob@example.org"},
+			atmHeaders:   []header{{"Subject", fmt.Sprint(i), fmt.Sprintf("Subject: %d", i)}},
+			// Long enough that interleaved writes would show
+			body: strings.Repeat(fmt.Sprintf("Line of message %d\r\n", i), 500) + "From here on\r\n>From before",
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- mb.Handle(context.Background(), m)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(mb.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each message starts with its own separator line
+	separator := regexp.MustCompile(`(?m)^From (sender\d+@example\.com) .*\n`)
+	starts := separator.FindAllSubmatchIndex(data, -1)
+	if len(starts) != n {
+		t.Fatalf("Expected %d messages, got %d", n, len(starts))
+	}
+
+	seen := map[string]bool{}
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+
+		sender := string(data[start[2]:start[3]])
+		var id int
+		fmt.Sscanf(sender, "sender%d@", &id)
+		seen[sender] = true
+
+		want := "Return-Path: <" + sender + ">\n" +
+			"Delivered-To: bob@example.org\n" +
+			fmt.Sprintf("Subject: %d\n\n", id) +
+			strings.Repeat(fmt.Sprintf("Line of message %d\n", id), 500) +
+			">From here on\n>>From before\n\n"
+		if got := string(data[start[1]:end]); got != want {
+			t.Fatalf("Message from %s isn't intact:\n%q", sender, got)
+		}
+	}
+
+	if len(seen) != n {
+		t.Fatalf("Expected %d different messages, got %d", n, len(seen))
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// messageSizeBuckets are the upper bounds, in bytes, of the message size
+// histogram.
+var messageSizeBuckets = [...]int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+
+// Metrics counts what the server has been doing. Set it on Server to
+// collect them, it is served in the Prometheus text format by
+// ServeHTTP. A nil *Metrics collects nothing.
+type Metrics struct {
+	connectionsAccepted int64
+	messagesReceived    int64
+	bytesReceived       int64
+	authSuccesses       int64
+	authFailures        int64
+
+	mu         sync.Mutex
+	commands   map[string]int64
+	rejections map[int]int64
+	// sizes[i] counts messages no larger than messageSizeBuckets[i],
+	// the last one counts the rest
+	sizes [len(messageSizeBuckets) + 1]int64
+}
+
+func (m *Metrics) connectionAccepted() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.connectionsAccepted, 1)
+}
+
+func (m *Metrics) messageReceived(size int) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.messagesReceived, 1)
+	atomic.AddInt64(&m.bytesReceived, int64(size))
+
+	i := 0
+	for i < len(messageSizeBuckets) && int64(size) > messageSizeBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&m.sizes[i], 1)
+}
+
+func (m *Metrics) authAttempt(ok bool) {
+	if m == nil {
+		return
+	}
+
+	if ok {
+		atomic.AddInt64(&m.authSuccesses, 1)
+	} else {
+		atomic.AddInt64(&m.authFailures, 1)
+	}
+}
+
+// command counts a command by verb. Verbs the server doesn't know are
+// lumped together so clients can't blow up the number of series.
+func (m *Metrics) command(verb string) {
+	if m == nil {
+		return
+	}
+
+	if _, ok := commands[verb]; !ok {
+		verb = "UNKNOWN"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.commands == nil {
+		m.commands = map[string]int64{}
+	}
+	m.commands[verb]++
+}
+
+// reply counts replies that refuse something, 4xx and 5xx.
+func (m *Metrics) reply(code int) {
+	if m == nil || code < 400 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejections == nil {
+		m.rejections = map[int]int64{}
+	}
+	m.rejections[code]++
+}
+
+// rejectionCounts returns a copy of the number of refusals by reply
+// code.
+func (m *Metrics) rejectionCounts() map[int]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[int]int64{}
+	for code, n := range m.rejections {
+		counts[code] = n
+	}
+
+	return counts
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	printf := func(format string, args ...interface{}) error {
+		written, err := fmt.Fprintf(w, format, args...)
+		n += int64(written)
+		return err
+	}
+
+	counters := []struct {
+		name, help string
+		value      *int64
+	}{
+		{"gomail_connections_accepted_total", "Connections accepted.", &m.connectionsAccepted},
+		{"gomail_messages_received_total", "Messages received.", &m.messagesReceived},
+		{"gomail_received_bytes_total", "Bytes of message bodies received.", &m.bytesReceived},
+		{"gomail_auth_successes_total", "Successful authentications.", &m.authSuccesses},
+		{"gomail_auth_failures_total", "Failed authentications.", &m.authFailures},
+	}
+	for _, counter := range counters {
+		err := printf("# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			counter.name, counter.help, counter.name, counter.name, atomic.LoadInt64(counter.value))
+		if err != nil {
+			return n, err
+		}
+	}
+
+	err := printf("# HELP gomail_message_size_bytes Size of message bodies received.\n# TYPE gomail_message_size_bytes histogram\n")
+	if err != nil {
+		return n, err
+	}
+
+	var cumulative int64
+	for i, bound := range messageSizeBuckets {
+		cumulative += atomic.LoadInt64(&m.sizes[i])
+		err = printf("gomail_message_size_bytes_bucket{le=\"%d\"} %d\n", bound, cumulative)
+		if err != nil {
+			return n, err
+		}
+	}
+	cumulative += atomic.LoadInt64(&m.sizes[len(messageSizeBuckets)])
+	err = printf("gomail_message_size_bytes_bucket{le=\"+Inf\"} %d\ngomail_message_size_bytes_sum %d\ngomail_message_size_bytes_count %d\n",
+		cumulative, atomic.LoadInt64(&m.bytesReceived), cumulative)
+	if err != nil {
+		return n, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = printf("# HELP gomail_commands_total Commands received, by verb.\n# TYPE gomail_commands_total counter\n")
+	if err != nil {
+		return n, err
+	}
+
+	var verbs []string
+	for verb := range m.commands {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for _, verb := range verbs {
+		err = printf("gomail_commands_total{verb=%q} %d\n", verb, m.commands[verb])
+		if err != nil {
+			return n, err
+		}
+	}
+
+	err = printf("# HELP gomail_rejections_total Replies refusing a command, by code.\n# TYPE gomail_rejections_total counter\n")
+	if err != nil {
+		return n, err
+	}
+
+	var codes []int
+	for code := range m.rejections {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		err = printf("gomail_rejections_total{code=\"%d\"} %d\n", code, m.rejections[code])
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// ServeHTTP serves the metrics for scraping, e.g. on /metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := m.WriteTo(w)
+	if err != nil {
+		logError(err)
+	}
+}
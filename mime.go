@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// headerDecoder decodes RFC 2047 encoded words. Charsets other than
+// UTF-8, US-ASCII and ISO-8859-1 aren't known to it.
+var headerDecoder = &mime.WordDecoder{}
+
+// decodeHeaderValue decodes the encoded words in a header value. Words
+// in a charset that can't be decoded, and malformed ones, are left as
+// they are rather than losing the rest of the value.
+func decodeHeaderValue(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err == nil {
+		return decoded
+	}
+
+	// Try the words one at a time to keep what can be decoded
+	fields := strings.Fields(value)
+	var b strings.Builder
+	prevEncoded := false
+	for i, field := range fields {
+		word, err := headerDecoder.Decode(field)
+		encoded := err == nil
+		if !encoded {
+			word = field
+		}
+
+		// Whitespace between adjacent encoded words is not part of
+		// the text, RFC 2047 section 6.2
+		if i > 0 && !(encoded && prevEncoded) {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(word)
+		prevEncoded = encoded
+	}
+
+	return b.String()
+}
+
+// part is one MIME entity of a message. The children of a multipart
+// entity are in parts, its own content is left empty.
+type part struct {
+	header      textproto.MIMEHeader
+	contentType string
+	// content is decoded according to the part's
+	// Content-Transfer-Encoding.
+	content []byte
+	parts   []part
+}
+
+var errUnknownEncoding = errors.New("Unknown Content-Transfer-Encoding")
+
+// decodeTransferEncoding undoes a Content-Transfer-Encoding, RFC 2045
+// section 6. 7bit, 8bit and binary content is returned as is.
+func decodeTransferEncoding(encoding, content string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return []byte(content), nil
+	case "base64":
+		// Line breaks are ignored by the decoder, but other whitespace
+		// isn't
+		return base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' {
+				return -1
+			}
+
+			return r
+		}, content))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(strings.NewReader(content)))
+	default:
+		return nil, errUnknownEncoding
+	}
+}
+
+// decodeBody fills in m.decodedBody from m.body. If the body can't be
+// decoded it is used as is.
+func (c *connection) decodeBody(m *message) {
+	encoding := m.header("Content-Transfer-Encoding")
+	decoded, err := decodeTransferEncoding(encoding, m.body)
+	if err != nil {
+		c.logInfo("Warning: leaving body undecoded, %s: %s", err, encoding)
+		decoded = []byte(m.body)
+	}
+
+	m.decodedBody = decoded
+}
+
+const (
+	// maxMIMEDepth and maxMIMEParts bound the MIME structure parsed for
+	// a message, deeper or bigger ones are left as a single part.
+	maxMIMEDepth = 20
+	maxMIMEParts = 1000
+)
+
+var errMIMETooComplex = errors.New("MIME structure nested too deep or with too many parts")
+
+// mimeParser builds the MIME tree of one message.
+type mimeParser struct {
+	// parts counts the entities parsed so far.
+	parts int
+}
+
+// parsePart builds the MIME tree for an entity with the given header
+// and raw body, descending into multipart bodies. depth is how many
+// multipart entities the entity is inside. Children are parsed straight
+// from the reader of their parent, only the content of the leaves is
+// read in.
+func (mp *mimeParser) parsePart(header textproto.MIMEHeader, body io.Reader, depth int) (part, error) {
+	p := part{header: header, contentType: "text/plain"}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil {
+		p.contentType = mediaType
+	}
+
+	if !strings.HasPrefix(p.contentType, "multipart/") {
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return p, err
+		}
+
+		p.content, err = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), string(raw))
+		if err != nil {
+			p.content = raw
+		}
+
+		return p, nil
+	}
+
+	if depth >= maxMIMEDepth {
+		return p, errMIMETooComplex
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return p, errors.New("Multipart message without boundary")
+	}
+
+	r := multipart.NewReader(body, boundary)
+	for {
+		// NextPart would decode quoted-printable itself and drop the
+		// header, do it the same way as for every other encoding
+		// instead
+		raw, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, err
+		}
+
+		mp.parts++
+		if mp.parts > maxMIMEParts {
+			return p, errMIMETooComplex
+		}
+
+		child, err := mp.parsePart(raw.Header, raw, depth+1)
+		if err != nil {
+			return p, err
+		}
+
+		p.parts = append(p.parts, child)
+	}
+
+	return p, nil
+}
+
+// parseParts fills in m.parts. A message that isn't multipart, or that
+// can't be parsed as one, becomes a single part holding the whole body.
+func (c *connection) parseParts(m *message) {
+	mimeHeader := textproto.MIMEHeader{}
+	for _, h := range m.atmHeaders {
+		mimeHeader.Add(h.name, h.value)
+	}
+
+	var mp mimeParser
+	p, err := mp.parsePart(mimeHeader, strings.NewReader(m.body), 0)
+	if err != nil {
+		c.logInfo("Warning: treating message as a single part, %s", err)
+		m.parts = []part{{header: mimeHeader, contentType: p.contentType, content: m.decodedBody}}
+		return
+	}
+
+	if p.parts == nil {
+		m.parts = []part{p}
+		return
+	}
+
+	m.parts = p.parts
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts every binary PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("Malformed PROXY protocol header")
+
+// proxyConn is a connection whose peer address was reported by a proxy
+// in front of the server.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, that
+// the proxy sends before anything from the client, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt. The
+// returned connection reports the client's address as its remote
+// address, unless the proxy didn't pass one on.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	r := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV2Signature) {
+		err = pc.readV2()
+	} else {
+		err = pc.readV1()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// readV1 parses the text header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func (pc *proxyConn) readV1() error {
+	var line []byte
+	// The longest possible header is 107 bytes
+	for len(line) < 107 {
+		b, err := pc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errBadProxyHeader
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return errBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return errBadProxyHeader
+	}
+
+	pc.remote = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
+
+// readV2 parses the binary header.
+func (pc *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(pc.r, header)
+	if err != nil {
+		return err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	// Only LOCAL and PROXY commands are defined
+	if verCmd>>4 != 2 || verCmd&0xf > 1 {
+		return errBadProxyHeader
+	}
+
+	addrs := make([]byte, length)
+	_, err = io.ReadFull(pc.r, addrs)
+	if err != nil {
+		return err
+	}
+
+	// LOCAL is for the proxy's own health checks, the address is its
+	// own
+	if verCmd&0xf == 0 {
+		return nil
+	}
+
+	switch family >> 4 {
+	case 1:
+		if len(addrs) < 12 {
+			return errBadProxyHeader
+		}
+
+		pc.remote = &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}
+	case 2:
+		if len(addrs) < 36 {
+			return errBadProxyHeader
+		}
+
+		pc.remote = &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}
+	}
+
+	// Other families, such as Unix sockets, have no address worth
+	// reporting
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	tests := []struct {
+		verCmd byte
+		want   string
+		ok     bool
+	}{
+		{0x21, "192.0.2.1:56324", true},
+		// LOCAL keeps the proxy's own address
+		{0x20, "pipe", true},
+		{0x22, "", false},
+		{0x2f, "", false},
+		{0x11, "", false},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		header := append(append([]byte{}, proxyV2Signature...), test.verCmd, 0x11, 0, byte(len(addrs)))
+		go func() {
+			client.Write(append(header, addrs...))
+		}()
+
+		conn, err := readProxyHeader(server, 0)
+		client.Close()
+		server.Close()
+		if !test.ok {
+			if err != errBadProxyHeader {
+				t.Errorf("%#x: expected %v, got %v", test.verCmd, errBadProxyHeader, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%#x: %v", test.verCmd, err)
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != test.want {
+			t.Errorf("%#x: expected %s, got %s", test.verCmd, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueMinBackoff = time.Minute
+	defaultQueueMaxBackoff = time.Hour
+	defaultQueueExpiry     = 5 * 24 * time.Hour
+	// queuePollInterval is how often the queue looks for messages that
+	// are due without being woken up.
+	queuePollInterval = 10 * time.Second
+)
+
+// QueuedMessage is a message waiting in a Queue.
+type QueuedMessage struct {
+	Message  *message
+	Queued   time.Time
+	Attempts int
+	// Next is when the next delivery attempt is due.
+	Next time.Time
+	// LastError is why the last attempt failed.
+	LastError string
+}
+
+// QueueStore keeps the messages of a Queue, e.g. in memory or on disk
+// so they survive a restart.
+type QueueStore interface {
+	// Put adds qm, or updates it if a message with the same ID is
+	// already queued.
+	Put(qm *QueuedMessage) error
+	Remove(id string) error
+	// Due returns the messages whose next attempt is due at now, the
+	// longest waiting first.
+	Due(now time.Time) ([]*QueuedMessage, error)
+}
+
+// Queue is a MessageHandler that accepts every message right away and
+// has Run hand them on to Deliver in the background, so clients don't
+// wait on, say, a smarthost. Temporary failures are retried with
+// exponential backoff. Messages that fail for good, or are still
+// undelivered after Expiry, are bounced back to their sender through
+// the queue.
+type Queue struct {
+	Deliver MessageHandler
+	// Hostname is announced as the sender of bounces. It defaults to
+	// localhost.
+	Hostname string
+	// MinBackoff is the wait before the first retry, doubled for every
+	// retry after up to MaxBackoff. They default to a minute and an
+	// hour.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Expiry is how long a message is retried. It defaults to five
+	// days, MaxAttempts, if set, also limits the number of attempts.
+	Expiry      time.Duration
+	MaxAttempts int
+	// Store keeps the queued messages. It defaults to a
+	// MemoryQueueStore.
+	Store QueueStore
+	// Logger receives delivery events. It defaults to a TextLogger at
+	// LevelInfo.
+	Logger Logger
+
+	once sync.Once
+	wake chan struct{}
+}
+
+func (q *Queue) init() {
+	q.once.Do(func() {
+		if q.Store == nil {
+			q.Store = &MemoryQueueStore{}
+		}
+
+		q.wake = make(chan struct{}, 1)
+	})
+}
+
+func (q *Queue) logger() Logger {
+	if q.Logger == nil {
+		return defaultLogger
+	}
+
+	return q.Logger
+}
+
+func (q *Queue) log(level Level, m *message, msg string) {
+	q.logger().Log(level, msg, Field{Key: FieldMessageID, Value: m.id})
+}
+
+// Handle queues m. m is copied, the server reuses it for the next
+// transaction on the connection.
+func (q *Queue) Handle(ctx context.Context, m *message) error {
+	q.init()
+	copied := *m
+	now := time.Now()
+	err := q.Store.Put(&QueuedMessage{Message: &copied, Queued: now, Next: now})
+	if err != nil {
+		return err
+	}
+
+	q.log(LevelInfo, m, "Queued message "+m.id)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run delivers queued messages as they become due, until ctx is
+// cancelled.
+func (q *Queue) Run(ctx context.Context) error {
+	q.init()
+	// next is the earliest retry scheduled here. Anything else the
+	// store has is found by looking again every queuePollInterval.
+	var next time.Time
+	for {
+		now := time.Now()
+		if !next.After(now) {
+			next = time.Time{}
+		}
+
+		due, err := q.Store.Due(now)
+		if err != nil {
+			q.logger().Log(LevelError, err.Error())
+		}
+
+		for _, qm := range due {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if q.attempt(ctx, qm) && (next.IsZero() || qm.Next.Before(next)) {
+				next = qm.Next
+			}
+		}
+
+		wait := queuePollInterval
+		if d := time.Until(next); !next.IsZero() && d < wait {
+			wait = d
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	min, max := q.MinBackoff, q.MaxBackoff
+	if min <= 0 {
+		min = defaultQueueMinBackoff
+	}
+	if max <= 0 {
+		max = defaultQueueMaxBackoff
+	}
+
+	backoff := min
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+
+	if backoff > max {
+		return max
+	}
+
+	return backoff
+}
+
+// attempt tries to deliver qm once, and then either forgets it or
+// schedules the next attempt. It reports whether it is to be retried.
+func (q *Queue) attempt(ctx context.Context, qm *QueuedMessage) bool {
+	m := qm.Message
+	err := q.Deliver.Handle(ctx, m)
+	if err == nil {
+		q.log(LevelInfo, m, "Delivered queued message "+m.id)
+		q.remove(m)
+		return false
+	}
+
+	q.log(LevelError, m, fmt.Sprintf("Delivering queued message %s failed: %s", m.id, err))
+	qm.Attempts++
+	qm.LastError = err.Error()
+
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		q.bounce(ctx, m, smtpErr.Error())
+		return false
+	}
+
+	expiry := q.Expiry
+	if expiry <= 0 {
+		expiry = defaultQueueExpiry
+	}
+
+	now := time.Now()
+	if now.Sub(qm.Queued) >= expiry || q.MaxAttempts > 0 && qm.Attempts >= q.MaxAttempts {
+		q.bounce(ctx, m, "451 4.4.7 Delivery time expired, last error: "+qm.LastError)
+		return false
+	}
+
+	qm.Next = now.Add(q.backoff(qm.Attempts))
+	err = q.Store.Put(qm)
+	if err != nil {
+		q.log(LevelError, m, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// bounce gives up on m, queueing a bounce to its sender.
+func (q *Queue) bounce(ctx context.Context, m *message, reply string) {
+	q.remove(m)
+
+	var failed []bounceFailure
+	for _, to := range m.envelopeTo {
+		failed = append(failed, bounceFailure{recipient: to, reply: reply})
+	}
+
+	hostname := q.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	bounce, ok := newBounce(hostname, "", m, failed)
+	if !ok {
+		q.log(LevelInfo, m, "Dropped undeliverable message "+m.id)
+		return
+	}
+
+	q.log(LevelInfo, m, "Bouncing message "+m.id+" as "+bounce.id)
+	err := q.Handle(ctx, bounce)
+	if err != nil {
+		q.log(LevelError, m, err.Error())
+	}
+}
+
+func (q *Queue) remove(m *message) {
+	err := q.Store.Remove(m.id)
+	if err != nil {
+		q.log(LevelError, m, err.Error())
+	}
+}
+
+// MemoryQueueStore is a QueueStore that loses everything still queued
+// when the server stops.
+type MemoryQueueStore struct {
+	mu       sync.Mutex
+	messages map[string]*QueuedMessage
+}
+
+func (s *MemoryQueueStore) Put(qm *QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messages == nil {
+		s.messages = map[string]*QueuedMessage{}
+	}
+
+	s.messages[qm.Message.id] = qm
+	return nil
+}
+
+func (s *MemoryQueueStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, id)
+	return nil
+}
+
+func (s *MemoryQueueStore) Due(now time.Time) ([]*QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*QueuedMessage
+	for _, qm := range s.messages {
+		if !qm.Next.After(now) {
+			due = append(due, qm)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Queued.Before(due[j].Queued)
+	})
+
+	return due, nil
+}
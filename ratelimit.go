@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// bucket is a token bucket, refilled continuously and capped at the
+// limiter's burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter hands out tokens per key, e.g. per remote address. A key
+// can spend up to burst tokens at once and earns them back at rate per
+// second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow spends a token for key, returning false if none are left.
+func (rl *rateLimiter) allow(key string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that would be full by now, since a fresh bucket
+// behaves the same. This keeps memory bounded by the number of
+// addresses seen recently rather than ever.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+
+	rl.lastSweep = now
+}
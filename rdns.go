@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// lookupRemoteHost finds the client's hostname from the PTR record of
+// its address. With Server.VerifyRemoteHost, only a name that resolves
+// back to the address is taken, forward-confirmed reverse DNS.
+func (c *connection) lookupRemoteHost() {
+	ip := net.ParseIP(remoteIP(c.clientAddr()))
+	if ip == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, defaultDNSTimeout)
+	defer cancel()
+
+	resolver := c.server.resolver()
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		c.logInfo("No reverse DNS for %s", ip)
+		return
+	}
+
+	if !c.server.VerifyRemoteHost {
+		c.remoteHost = strings.TrimSuffix(names[0], ".")
+		c.logInfo("Remote host: %s", c.remoteHost)
+		return
+	}
+
+	for _, name := range names {
+		if resolvesTo(ctx, resolver, name, ip) {
+			c.remoteHost = strings.TrimSuffix(name, ".")
+			c.remoteHostVerified = true
+			c.logInfo("Remote host: %s, forward-confirmed", c.remoteHost)
+			return
+		}
+	}
+
+	c.logInfo("Reverse DNS for %s doesn't resolve back to it: %s", ip, strings.Join(names, ", "))
+}
+
+func resolvesTo(ctx context.Context, resolver *net.Resolver, name string, ip net.IP) bool {
+	addrs, err := resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
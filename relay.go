@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// defaultRelayTimeout bounds a whole relay transaction when the
+// context given to Handle has no deadline.
+const defaultRelayTimeout = 5 * time.Minute
+
+// Relay is a MessageHandler that passes every message on to an upstream
+// SMTP server, a smarthost, instead of storing it.
+type Relay struct {
+	// Addr is the smarthost's host:port.
+	Addr string
+	// Hostname is announced to the smarthost in EHLO. It defaults to
+	// localhost.
+	Hostname string
+	// ImplicitTLS connects with TLS from the start (SMTPS). Otherwise
+	// STARTTLS is used when the smarthost offers it.
+	ImplicitTLS bool
+	// RequireTLS refuses to send anything to a smarthost that doesn't
+	// offer STARTTLS.
+	RequireTLS bool
+	// TLSConfig is used for either kind of TLS. It defaults to
+	// verifying the smarthost's certificate against its host name.
+	TLSConfig *tls.Config
+	// Username and Password, if set, are sent with AUTH PLAIN. For the
+	// password's sake this is only done over TLS.
+	Username string
+	Password string
+	// Bounces, if set, is given a bounce for the recipients the
+	// smarthost refuses for good, and those no longer fail the message
+	// for everyone else. The bounce can be sent back through the Relay
+	// itself.
+	Bounces MessageHandler
+	// Logger receives bounces that couldn't be sent. It defaults to a
+	// TextLogger at LevelInfo.
+	Logger Logger
+}
+
+func (r *Relay) logger() Logger {
+	if r.Logger == nil {
+		return defaultLogger
+	}
+
+	return r.Logger
+}
+
+func (r *Relay) hostname() string {
+	if r.Hostname == "" {
+		return "localhost"
+	}
+
+	return r.Hostname
+}
+
+func (r *Relay) tlsConfig() (*tls.Config, error) {
+	if r.TLSConfig != nil {
+		return r.TLSConfig, nil
+	}
+
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{ServerName: host}, nil
+}
+
+// Handle relays m. Replies the smarthost refuses the message with are
+// passed back to the client as an *SMTPError, so a permanent failure
+// upstream is a permanent failure here too.
+func (r *Relay) Handle(ctx context.Context, m *message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRelayTimeout)
+		defer cancel()
+	}
+
+	failed, err := r.send(ctx, m)
+	if err == nil && len(failed) > 0 {
+		host, _, _ := net.SplitHostPort(r.Addr)
+		if bounce, ok := newBounce(r.hostname(), host, m, failed); ok {
+			// The rest of the recipients already have the message, so
+			// failing it would have it sent to them again on a retry
+			bounceErr := r.Bounces.Handle(ctx, bounce)
+			if bounceErr != nil {
+				r.logger().Log(LevelError, fmt.Sprintf("Failed to send bounce for message %s: %s", m.id, bounceErr), Field{Key: FieldMessageID, Value: m.id})
+			}
+		}
+
+		return nil
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		if protoErr.Code >= 500 {
+			return &SMTPError{Code: 554, Message: "Transaction failed upstream: " + protoErr.Msg}
+		}
+
+		return &SMTPError{Code: 451, Message: "Requested action aborted upstream: " + protoErr.Msg}
+	}
+
+	return err
+}
+
+// refused reports whether err is a permanent refusal that should be
+// bounced rather than fail the whole message.
+func (r *Relay) refused(err error) (string, bool) {
+	var protoErr *textproto.Error
+	if r.Bounces == nil || !errors.As(err, &protoErr) || protoErr.Code < 500 {
+		return "", false
+	}
+
+	return strconv.Itoa(protoErr.Code) + " " + protoErr.Msg, true
+}
+
+// send passes m on to the smarthost. It returns the recipients that
+// are to be bounced, see Bounces.
+func (r *Relay) send(ctx context.Context, m *message) ([]bounceFailure, error) {
+	tlsConfig, err := r.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if r.ImplicitTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, tlsConfig.ServerName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer client.Close()
+
+	err = client.Hello(r.hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := r.ImplicitTLS
+	if ok, _ := client.Extension("STARTTLS"); ok && !encrypted {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted = true
+	}
+
+	if r.RequireTLS && !encrypted {
+		return nil, errors.New("Smarthost " + r.Addr + " does not offer STARTTLS")
+	}
+
+	if r.Username != "" {
+		if !encrypted {
+			return nil, errors.New("Refusing to authenticate to smarthost " + r.Addr + " without TLS")
+		}
+
+		err = client.Auth(smtp.PlainAuth("", r.Username, r.Password, tlsConfig.ServerName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = client.Mail(m.envelopeFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []bounceFailure
+	var accepted []string
+	for _, to := range m.envelopeTo {
+		err = client.Rcpt(to)
+		if reply, ok := r.refused(err); ok {
+			failed = append(failed, bounceFailure{recipient: to, reply: reply})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		accepted = append(accepted, to)
+	}
+
+	if len(accepted) == 0 {
+		return failed, client.Quit()
+	}
+
+	err = r.data(client, m)
+	if reply, ok := r.refused(err); ok {
+		for _, to := range accepted {
+			failed = append(failed, bounceFailure{recipient: to, reply: reply})
+		}
+
+		return failed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return failed, client.Quit()
+}
+
+func (r *Relay) data(client *smtp.Client, m *message) error {
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(m.content())
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxMessageSize = 10 << 20
+	// hardMaxMessageSize caps messages even when MaxMessageSize doesn't,
+	// so no client can claim an unbounded amount of memory.
+	hardMaxMessageSize = 1 << 30
+	// RFC 5321 section 4.5.3.1.4
+	defaultMaxLineLength = 512
+	// RFC 5321 section 4.5.3.2 suggests at least 5 minutes for most
+	// replies
+	defaultReadTimeout  = 5 * time.Minute
+	defaultWriteTimeout = time.Minute
+	defaultDrainTimeout = 30 * time.Second
+	defaultAddr         = ":25"
+	// RFC 5321 section 4.5.3.1.8 asks for at least 100
+	defaultMaxRecipients = 100
+	defaultMaxHeaders    = 1000
+	defaultMaxHeaderSize = 1 << 20
+	// Plenty for a client sending a large batch over one session
+	defaultMaxSessionDuration = time.Hour
+	defaultMaxCommands        = 10000
+)
+
+// Server holds the configuration shared by every connection.
+type Server struct {
+	// Addr is the address ListenAndServe accepts plain SMTP on. It
+	// defaults to :25.
+	Addr string
+	// ImplicitTLSAddr, if set, is an address ListenAndServe accepts
+	// implicit TLS (SMTPS) on, using ImplicitTLSConfig.
+	ImplicitTLSAddr string
+	// LMTPAddr, if set, is an address ListenAndServe accepts LMTP on.
+	LMTPAddr string
+	// Hostname is announced in the greeting and EHLO reply. It defaults
+	// to the system hostname.
+	Hostname string
+	// Greeting is the text of the 220 greeting following Hostname. It
+	// defaults to "ESMTP ready", or "LMTP ready" for LMTP. Clients may
+	// try EHLO either way, ESMTP in the greeting is only a hint.
+	Greeting string
+	// MaxMessageSize is the largest message accepted, in bytes, counting
+	// its header block and body as sent. It applies alike to DATA, BDAT
+	// and the size declared with SIZE. Zero means no limit short of 1
+	// GiB.
+	MaxMessageSize int
+	// MaxLineLength is the longest command line accepted, in bytes and
+	// including the line ending. Zero means no limit.
+	MaxLineLength int
+	// MaxRecipients is the most RCPT TO commands accepted per message.
+	// Zero means no limit.
+	MaxRecipients int
+	// MaxHeaders and MaxHeaderSize limit the number of header fields of
+	// a message and the size of its header block in bytes. Zero means
+	// no limit.
+	MaxHeaders    int
+	MaxHeaderSize int
+	// MaxSessionDuration and MaxCommands limit how long a session may
+	// last and how many commands the client may send in it, after which
+	// it gets a 421 and is disconnected. Zero means no limit.
+	MaxSessionDuration time.Duration
+	MaxCommands        int
+	// TLSConfig enables STARTTLS when set.
+	TLSConfig *tls.Config
+	// TLSMinVersion and TLSCipherSuites, if set, override those of
+	// TLSConfig and ImplicitTLSConfig. The minimum version defaults to
+	// TLS 1.2. Serve fails on a policy no connection could meet, such as
+	// an unknown or insecure cipher suite.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	// TLSCertificates, if set, picks the certificate for a TLS
+	// connection by the server name the client asks for with SNI,
+	// falling back to the configuration's own. Names are matched case
+	// insensitively, and "*.example.com" stands for any name one label
+	// below example.com.
+	TLSCertificates map[string]*tls.Certificate
+	// ReadTimeout and WriteTimeout bound how long a single read from or
+	// write to the client may block. Zero means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Authenticator enables AUTH over TLS when set.
+	Authenticator Authenticator
+	// ClientCertResolver enables AUTH EXTERNAL for clients with a TLS
+	// client certificate that verified. TLSConfig has to ask for them,
+	// e.g. with ClientAuth set to tls.VerifyClientCertIfGiven.
+	ClientCertResolver ClientCertResolver
+	// RecipientVerifier answers VRFY when set. Without one every query
+	// gets a noncommittal 252.
+	RecipientVerifier RecipientVerifier
+	// ListExpander answers EXPN when set. Without one EXPN is not
+	// implemented.
+	ListExpander ListExpander
+	// AliasResolver, if set, rewrites each recipient of RCPT into the
+	// addresses it is an alias of. The targets may be anywhere, they
+	// aren't subject to the relay checks.
+	AliasResolver AliasResolver
+	// Handler is given each accepted message. It defaults to one that
+	// only logs it.
+	Handler MessageHandler
+	// RequireAuth refuses MAIL FROM until the client has authenticated.
+	// Since AUTH is only offered over TLS, so is sending mail.
+	RequireAuth bool
+	// RequireTLS refuses MAIL FROM and AUTH with a 530 until the client
+	// has issued STARTTLS. LMTP sessions are exempt, they come from a
+	// local delivery agent.
+	RequireTLS bool
+	// SynthesizeHeaders adds a Date, From and Message-ID header to
+	// messages missing them, as a submission server may, RFC 6409
+	// section 8. Date is the time the message was received, From the
+	// authenticated identity or else the envelope sender, and
+	// Message-ID is made from the transaction id. A relay shouldn't
+	// rewrite messages, so this is off by default.
+	SynthesizeHeaders bool
+	// ImplicitTLSConfig is used by ServeTLS to encrypt connections from
+	// the start.
+	ImplicitTLSConfig *tls.Config
+	// DrainTimeout is how long Serve waits for open connections to close
+	// once shutdown begins. Zero means wait indefinitely.
+	DrainTimeout time.Duration
+
+	// MaxConnections and MaxConnectionsPerIP limit how many sessions may
+	// be open at once, in total and from a single address. Clients past
+	// either limit are turned away with a 421. Zero means no limit.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// MaxConnectionRate is how many new connections a single address may
+	// open per minute, with up to that many at once. Clients past it are
+	// turned away with a 421. Zero means no limit.
+	MaxConnectionRate int
+	// Metrics, if set, is updated as the server runs.
+	Metrics *Metrics
+	// ProxyProtocol expects every connection to start with a PROXY
+	// protocol header, version 1 or 2, and takes the client's address
+	// from it. Only set it when every connection comes through a
+	// trusted proxy, since a client could claim any address.
+	ProxyProtocol bool
+	// CheckSPF checks the envelope sender against the SPF record of its
+	// domain, RFC 7208, and records the result on the message.
+	CheckSPF bool
+	// RejectSPFFail refuses MAIL FROM with a 550 when the SPF result is
+	// a hard fail.
+	RejectSPFFail bool
+	// VerifyDKIM checks the DKIM-Signature headers of every message,
+	// RFC 6376, and records the results on the message.
+	VerifyDKIM bool
+	// DenyList turns clients from these networks away with a 554 as soon
+	// as they connect, unless they are also in AllowList.
+	DenyList  []*net.IPNet
+	AllowList []*net.IPNet
+	// AllowListSkipsChecks exempts clients in AllowList from
+	// MaxConnectionRate and Greylist.
+	AllowListSkipsChecks bool
+	// XClientAllowList are the networks of trusted front-ends, such as
+	// a Postfix proxy, allowed to pass on the original client's
+	// address, hostname, greeting and login with XCLIENT. Nobody is by
+	// default.
+	XClientAllowList []*net.IPNet
+	// XStatAllowList are the networks of clients allowed to ask for the
+	// server's statistics with XSTAT, which needs Metrics. Nobody is by
+	// default.
+	XStatAllowList []*net.IPNet
+	// OnConnect, if set, is asked about every client before the
+	// greeting. Clients it doesn't accept get the reply with code and
+	// msg and are disconnected. A code that isn't 4xx or 5xx stands for
+	// 554.
+	OnConnect func(remoteAddr net.Addr) (accept bool, code int, msg string)
+	// OnHeader, if set, is shown every header of a message as it is
+	// read, and returns the value to store in its place. If it rejects
+	// any header the message is refused with a 550.
+	OnHeader func(name, value string) (rewrittenValue string, reject bool)
+	// Filter, if set, is shown every complete message before Handler
+	// is. A 4xx or 5xx code refuses the message with that reply, and
+	// Handler never sees it. Zero or a 2xx code lets it through.
+	Filter func(m *message) (code int, msg string)
+	// Tarpit, if set, is asked before every reply how long to hold it
+	// back, to slow down clients suspected of abuse. It is told the
+	// code of the reply, so it can slow down only errors for instance.
+	// Zero sends the reply straight away.
+	Tarpit func(remoteAddr net.Addr, code int) time.Duration
+	// LocalDomains are the domains mail is accepted for from anyone.
+	// They default to Hostname alone. Clients have to authenticate to
+	// send mail anywhere else, unless the domain is in RelayDomains.
+	LocalDomains []string
+	RelayDomains []string
+	// LookupRemoteHost finds the client's hostname with a PTR lookup
+	// as it connects, for logs, the Received header and Filter. It
+	// costs a DNS lookup per connection.
+	LookupRemoteHost bool
+	// VerifyRemoteHost, with LookupRemoteHost, only takes a hostname that
+	// resolves back to the client's address.
+	VerifyRemoteHost bool
+	// Greylist, if set, is consulted for every recipient.
+	Greylist *Greylist
+	// Resolver is used for DNS lookups. It defaults to
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+	// Logger receives the server's log events. It defaults to a
+	// TextLogger at LevelInfo.
+	Logger Logger
+
+	lastID   int32
+	draining int32
+	// serving counts the listeners being served, see HealthHandler.
+	serving int32
+	mu      sync.Mutex
+	// started is when the first listener began to be served.
+	started    time.Time
+	conns      map[net.Conn]struct{}
+	connsPerIP map[string]int
+	wg         sync.WaitGroup
+	limiter    *rateLimiter
+	// sessions is the parent of every session's context. It is
+	// cancelled when draining gives up on the sessions left.
+	sessions     context.Context
+	stopSessions context.CancelFunc
+	// shutdown is closed once draining starts, see shutdownStarted.
+	shutdown chan struct{}
+	// startTLSConfig and implicitTLSConfig are TLSConfig and
+	// ImplicitTLSConfig with the TLS policy applied, see prepareTLS.
+	tlsOnce           sync.Once
+	tlsErr            error
+	startTLSConfig    *tls.Config
+	implicitTLSConfig *tls.Config
+}
+
+var (
+	errMessageTooLarge = errors.New("Message exceeds maximum size")
+	errShuttingDown    = errors.New("Server is shutting down")
+	errLineTooLong     = errors.New("Line exceeds maximum length")
+	errHeaderTooLarge  = errors.New("Header exceeds maximum size")
+	errIncompleteData  = errors.New("Connection closed before end of data")
+)
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "localhost"
+	}
+
+	return name
+}
+
+func (s *Server) handler() MessageHandler {
+	if s.Handler == nil {
+		return logHandler{logger: s.logger()}
+	}
+
+	return s.Handler
+}
+
+// Listen opens a listener on Addr. If Addr asks for an ephemeral port,
+// such as 127.0.0.1:0, the listener's Addr reports the one that was
+// bound.
+func (s *Server) Listen() (net.Listener, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	return listen(addr)
+}
+
+// listen opens a TCP listener, or a Unix socket one for an address
+// like unix:/path/to/sock. The socket file is removed again when the
+// listener is closed.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	// Left behind by a server that didn't shut down cleanly, nothing
+	// can be listening on it any more if dialing fails
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// ListenAndServe listens on Addr, and on ImplicitTLSAddr and LMTPAddr
+// when set, and serves them all until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	// Before listening, so a bad TLS policy fails right away
+	err := s.prepareTLS()
+	if err != nil {
+		return err
+	}
+
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	s.logInfo("Listening on " + l.Addr().String())
+	serving := []func() error{func() error { return s.Serve(ctx, l) }}
+	closeAll := []net.Listener{l}
+
+	extra := []struct {
+		addr, name string
+		serve      func(context.Context, net.Listener) error
+	}{
+		{s.ImplicitTLSAddr, "implicit TLS", s.ServeTLS},
+		{s.LMTPAddr, "LMTP", s.ServeLMTP},
+	}
+	for _, e := range extra {
+		if e.addr == "" {
+			continue
+		}
+
+		el, err := listen(e.addr)
+		if err != nil {
+			for _, l := range closeAll {
+				l.Close()
+			}
+
+			return err
+		}
+
+		s.logInfo("Listening for " + e.name + " on " + el.Addr().String())
+		serve := e.serve
+		serving = append(serving, func() error { return serve(ctx, el) })
+		closeAll = append(closeAll, el)
+	}
+
+	errs := make(chan error, len(serving))
+	for _, serve := range serving {
+		go func(serve func() error) {
+			errs <- serve()
+		}(serve)
+	}
+
+	for range serving {
+		if serveErr := <-errs; err == nil {
+			err = serveErr
+		}
+	}
+
+	return err
+}
+
+// listenerMode is how the connections accepted on one listener are
+// served.
+type listenerMode struct {
+	// implicitTLS, if set, encrypts connections from the first byte.
+	implicitTLS *tls.Config
+	// lmtp speaks LMTP rather than SMTP.
+	lmtp bool
+}
+
+// Serve accepts connections on l until ctx is cancelled. It then stops
+// accepting, tells clients that are still connected that the server is
+// going away and waits up to DrainTimeout for their sessions to end.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, listenerMode{})
+}
+
+// ServeTLS is like Serve, but every connection is encrypted with
+// ImplicitTLSConfig from the first byte (SMTPS).
+func (s *Server) ServeTLS(ctx context.Context, l net.Listener) error {
+	if s.ImplicitTLSConfig == nil {
+		return errors.New("ServeTLS requires ImplicitTLSConfig")
+	}
+
+	err := s.prepareTLS()
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ctx, l, listenerMode{implicitTLS: s.implicitTLSConfig})
+}
+
+// ServeLMTP is like Serve, but speaks LMTP, RFC 2033, for handing mail
+// to a local delivery agent.
+func (s *Server) ServeLMTP(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, listenerMode{lmtp: true})
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener, mode listenerMode) error {
+	err := s.prepareTLS()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt32(&s.serving, 1)
+	defer atomic.AddInt32(&s.serving, -1)
+
+	s.mu.Lock()
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.mu.Unlock()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return s.drain()
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			s.logError(err)
+			continue
+		}
+
+		ok, overLimit := s.track(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+
+		id := atomic.AddInt32(&s.lastID, 1)
+		s.Metrics.connectionAccepted()
+		go s.serveConn(conn, int(id), overLimit, mode)
+	}
+}
+
+// serveConn runs the session on a tracked connection.
+func (s *Server) serveConn(conn net.Conn, id int, overLimit bool, mode listenerMode) {
+	defer s.untrack(conn)
+
+	// Per-address limits wait for the PROXY header, which has the
+	// address that counts
+	c := connection{server: s, conn: conn, id: id, lmtp: mode.lmtp}
+	if s.ProxyProtocol {
+		var err error
+		c.conn, err = readProxyHeader(conn, s.ReadTimeout)
+		if err != nil {
+			c.conn = conn
+			c.logError(err)
+			conn.Close()
+			return
+		}
+	}
+
+	ip := remoteIP(c.conn.RemoteAddr())
+	allowed := containsIP(s.AllowList, net.ParseIP(ip))
+	denied := !allowed && containsIP(s.DenyList, net.ParseIP(ip))
+	c.trusted = allowed && s.AllowListSkipsChecks
+
+	overLimit = !s.trackIP(ip) || overLimit
+	defer s.untrackIP(ip)
+	limited := !c.trusted && !s.allowConnection(ip)
+
+	if mode.implicitTLS != nil {
+		c.conn = tls.Server(c.conn, mode.implicitTLS)
+		c.tls = true
+	}
+
+	if denied {
+		c.reject(554, "Access denied")
+		return
+	}
+
+	if overLimit {
+		c.reject(421, "Too many connections, try again later")
+		return
+	}
+
+	if limited {
+		c.reject(421, "Too many connections from your address, try again later")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.sessionContext())
+	defer cancel()
+	if s.MaxSessionDuration > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.MaxSessionDuration)
+		defer cancelTimeout()
+	}
+	c.handle(ctx)
+}
+
+// track registers a newly accepted connection. It returns false if the
+// server is already shutting down. overLimit is set when the connection
+// takes the server past MaxConnections, it is tracked all the same and
+// must be untracked.
+func (s *Server) track(conn net.Conn) (ok, overLimit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown() {
+		return false, false
+	}
+
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true, s.MaxConnections > 0 && len(s.conns) > s.MaxConnections
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// trackIP counts a session from ip, returning false if that takes it
+// past MaxConnectionsPerIP. Either way it must be untracked.
+func (s *Server) trackIP(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connsPerIP == nil {
+		s.connsPerIP = map[string]int{}
+	}
+
+	s.connsPerIP[ip]++
+	return s.MaxConnectionsPerIP <= 0 || s.connsPerIP[ip] <= s.MaxConnectionsPerIP
+}
+
+func (s *Server) untrackIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// allowConnection reports whether ip is still within
+// MaxConnectionRate.
+func (s *Server) allowConnection(ip string) bool {
+	if s.MaxConnectionRate <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	if s.limiter == nil {
+		s.limiter = newRateLimiter(s.MaxConnectionRate)
+	}
+	limiter := s.limiter
+	s.mu.Unlock()
+
+	return limiter.allow(ip, time.Now())
+}
+
+// maxMessageSize is the largest message accepted, see MaxMessageSize.
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize <= 0 || s.MaxMessageSize > hardMaxMessageSize {
+		return hardMaxMessageSize
+	}
+
+	return s.MaxMessageSize
+}
+
+// remoteIP returns the host part of addr, which is what per-client
+// limits are keyed on. Clients on a Unix socket have no address of
+// their own, so they all share an empty one.
+func remoteIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UnixAddr:
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// sessionContext returns the context sessions are run in.
+func (s *Server) sessionContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions, s.stopSessions = context.WithCancel(context.Background())
+	}
+
+	return s.sessions
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// shutdownStarted returns a channel that is closed once the server
+// starts shutting down.
+func (s *Server) shutdownStarted() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdownLocked()
+}
+
+func (s *Server) shutdownLocked() chan struct{} {
+	if s.shutdown == nil {
+		s.shutdown = make(chan struct{})
+	}
+
+	return s.shutdown
+}
+
+// drain interrupts every open connection and waits for them to close,
+// forcing them closed once DrainTimeout passes.
+func (s *Server) drain() error {
+	s.mu.Lock()
+	// Every listener drains when it stops
+	if !s.shuttingDown() {
+		close(s.shutdownLocked())
+	}
+	atomic.StoreInt32(&s.draining, 1)
+	for conn := range s.conns {
+		// Wakes up a blocked read, see connection.read
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	if s.DrainTimeout <= 0 {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(s.DrainTimeout):
+	}
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.stopSessions != nil {
+		s.stopSessions()
+	}
+	s.mu.Unlock()
+
+	return errors.New("Timed out waiting for connections to close")
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in the tests, so a server that stops
+// answering fails the test instead of hanging it.
+const testTimeout = 5 * time.Second
+
+// discardLogger drops every event, tests only look at replies.
+type discardLogger struct{}
+
+func (discardLogger) Log(level Level, msg string, fields ...Field) {}
+
+// collectHandler is a MessageHandler keeping every message it is
+// given. err, if set, is returned from Handle instead.
+type collectHandler struct {
+	mu   sync.Mutex
+	msgs []message
+	err  error
+}
+
+func (h *collectHandler) Handle(ctx context.Context, m *message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err != nil {
+		return h.err
+	}
+
+	// The connection reuses m for its next transaction
+	h.msgs = append(h.msgs, *m)
+	return nil
+}
+
+func (h *collectHandler) messages() []message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]message(nil), h.msgs...)
+}
+
+// startServer serves s on an ephemeral loopback port until the test
+// ends, and returns the address to connect to. Unless they are set, s
+// gets a discardLogger and the host name example.org, which makes it
+// the local domain.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	return startServing(t, s, s.Serve)
+}
+
+// startServing is startServer with another of the server's Serve
+// methods, such as ServeTLS.
+func startServing(t *testing.T, s *Server, serve func(context.Context, net.Listener) error) string {
+	t.Helper()
+
+	if s.Hostname == "" {
+		s.Hostname = "example.org"
+	}
+	if s.Logger == nil {
+		s.Logger = discardLogger{}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Serve: %s", err)
+			}
+		case <-time.After(testTimeout):
+			t.Errorf("Serve did not return after the server was stopped")
+		}
+	})
+
+	return l.Addr().String()
+}
+
+// waitIdle waits until every session on s has ended, failing the test
+// if one is left running.
+func waitIdle(t *testing.T, s *Server) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still running", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testCertificate returns a self-signed certificate for names, the
+// first of which is also its common name.
+func testCertificate(t *testing.T, names ...string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// x509Pool returns a pool trusting the self-signed certs.
+func x509Pool(t *testing.T, certs ...*tls.Certificate) *x509.CertPool {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert.Leaf)
+	}
+
+	return pool
+}
+
+// testClient drives a session from the client's side: send writes
+// lines and expect checks the reply that comes back.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial connects to the server at addr without reading the greeting.
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// dialTLS connects to the server at addr with implicit TLS, see
+// Server.ServeTLS, and reads its greeting.
+func dialTLS(t *testing.T, addr string, config *tls.Config) (*testClient, tls.ConnectionState) {
+	t.Helper()
+
+	tc := dial(t, addr)
+	conn := tls.Client(tc.conn, config)
+	err := conn.Handshake()
+	if err != nil {
+		t.Fatalf("TLS handshake: %s", err)
+	}
+
+	tc.conn, tc.r = conn, bufio.NewReader(conn)
+	tc.expect(220)
+	return tc, conn.ConnectionState()
+}
+
+// connect connects to the server at addr and reads its greeting.
+func connect(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	tc := dial(t, addr)
+	tc.expect(220)
+	return tc
+}
+
+// ehlo connects to the server at addr and greets it with EHLO,
+// returning the extensions it advertised.
+func ehlo(t *testing.T, addr string) (*testClient, []string) {
+	t.Helper()
+
+	tc := connect(t, addr)
+	lines := tc.cmd("EHLO client.example.com", 250)
+	return tc, lines[1:]
+}
+
+// startTLS sends STARTTLS and completes the handshake with config,
+// returning what was negotiated.
+func (tc *testClient) startTLS(config *tls.Config) tls.ConnectionState {
+	tc.t.Helper()
+
+	tc.cmd("STARTTLS", 220)
+	conn := tls.Client(tc.conn, config)
+	err := conn.Handshake()
+	if err != nil {
+		tc.t.Fatalf("TLS handshake: %s", err)
+	}
+
+	tc.conn, tc.r = conn, bufio.NewReader(conn)
+	return conn.ConnectionState()
+}
+
+// sendRaw writes s as it is.
+func (tc *testClient) sendRaw(s string) {
+	tc.t.Helper()
+
+	_, err := io.WriteString(tc.conn, s)
+	if err != nil {
+		tc.t.Fatalf("Sending %q: %s", s, err)
+	}
+}
+
+// send writes each line followed by CRLF, all at once, the way a
+// pipelining client would.
+func (tc *testClient) send(lines ...string) {
+	tc.t.Helper()
+	tc.sendRaw(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// reply reads the next reply, which may span several lines, and
+// returns its code and the text of each line.
+func (tc *testClient) reply() (int, []string) {
+	tc.t.Helper()
+
+	var lines []string
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("Reading reply after %q: %s", lines, err)
+		}
+
+		// Replies always end in CRLF, whatever the client sends
+		if !strings.HasSuffix(line, "\r\n") {
+			tc.t.Fatalf("Reply line %q doesn't end in CRLF", line)
+		}
+
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) < 4 || (line[3] != ' ' && line[3] != '-') {
+			tc.t.Fatalf("Malformed reply line %q", line)
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			tc.t.Fatalf("Malformed reply line %q", line)
+		}
+
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return code, lines
+		}
+	}
+}
+
+// expect reads the next reply and fails the test unless it has code.
+// It returns the text of each line of the reply.
+func (tc *testClient) expect(code int) []string {
+	tc.t.Helper()
+
+	got, lines := tc.reply()
+	if got != code {
+		tc.t.Fatalf("Expected %d, got %d %s", code, got, strings.Join(lines, " / "))
+	}
+
+	return lines
+}
+
+// cmd sends line and expects a reply with code.
+func (tc *testClient) cmd(line string, code int) []string {
+	tc.t.Helper()
+
+	tc.send(line)
+	return tc.expect(code)
+}
+
+// expectClosed fails the test unless the server closes the connection
+// without sending anything more.
+func (tc *testClient) expectClosed() {
+	tc.t.Helper()
+
+	b, err := tc.r.ReadByte()
+	if err == nil {
+		rest, _ := tc.r.ReadString('\n')
+		tc.t.Fatalf("Expected the connection to be closed, got %q", string(b)+rest)
+	}
+	if err != io.EOF {
+		tc.t.Fatalf("Expected the connection to be closed, got %s", err)
+	}
+}
+
+// startMail greets the server and starts a transaction from
+// alice@example.com to bob@example.org.
+func (tc *testClient) startMail() {
+	tc.t.Helper()
+
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+}
+
+// sendMessage sends data, which must end in CRLF, as the content of
+// the transaction in progress and expects code in reply.
+func (tc *testClient) sendMessage(data string, code int) []string {
+	tc.t.Helper()
+
+	tc.cmd("DATA", 354)
+	tc.sendRaw(data + ".\r\n")
+	return tc.expect(code)
+}
+
+func TestQuit(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("QUIT", 221)
+	tc.expectClosed()
+
+	// Before the greeting has even been read
+	tc = dial(t, addr)
+	tc.send("QUIT")
+	tc.expect(220)
+	tc.expect(221)
+	tc.expectClosed()
+
+	waitIdle(t, s)
+}
+
+func TestEarlyDisconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// session runs the client's side up to where it hangs up
+		session func(tc *testClient)
+	}{
+		{"before greeting", func(tc *testClient) {}},
+		{"after greeting", func(tc *testClient) {
+			tc.expect(220)
+		}},
+		{"after EHLO", func(tc *testClient) {
+			tc.expect(220)
+			tc.cmd("EHLO client.example.com", 250)
+		}},
+		{"mid command", func(tc *testClient) {
+			tc.expect(220)
+			tc.sendRaw("EHLO client.exa")
+		}},
+		{"after MAIL", func(tc *testClient) {
+			tc.expect(220)
+			tc.cmd("EHLO client.example.com", 250)
+			tc.cmd("MAIL FROM:<alice@example.com>", 250)
+		}},
+		{"after DATA", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.cmd("DATA", 354)
+		}},
+		{"mid header", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.cmd("DATA", 354)
+			tc.sendRaw("Subject: Hel")
+		}},
+		{"mid body", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.cmd("DATA", 354)
+			tc.sendRaw("Subject: Hello\r\n\r\nSome text\r\n")
+		}},
+		{"before final period", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.cmd("DATA", 354)
+			tc.sendRaw("Subject: Hello\r\n\r\nSome text\r\n.")
+		}},
+		{"mid BDAT", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.sendRaw("BDAT 100 LAST\r\nSubject: Hello\r\n")
+		}},
+		{"between BDAT chunks", func(tc *testClient) {
+			tc.expect(220)
+			tc.startMail()
+			tc.sendRaw("BDAT 18\r\nSubject: Hello\r\n\r\n")
+			tc.expect(250)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &collectHandler{}
+			s := &Server{Handler: h}
+			addr := startServer(t, s)
+
+			tc := dial(t, addr)
+			test.session(tc)
+			tc.conn.Close()
+			waitIdle(t, s)
+
+			if msgs := h.messages(); len(msgs) != 0 {
+				t.Fatalf("Expected no message to be delivered, got %d", len(msgs))
+			}
+
+			// The server is still there for the next client
+			tc = connect(t, addr)
+			tc.startMail()
+			tc.sendMessage("Subject: Hello\r\n\r\nSome text\r\n", 250)
+			tc.cmd("QUIT", 221)
+			waitIdle(t, s)
+
+			if msgs := h.messages(); len(msgs) != 1 {
+				t.Fatalf("Expected 1 message to be delivered, got %d", len(msgs))
+			}
+		})
+	}
+}
+
+func TestHalfClosedDuringData(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.cmd("DATA", 354)
+	tc.sendRaw("Subject: Hello\r\n\r\nSome text\r\n")
+	tc.conn.(*net.TCPConn).CloseWrite()
+
+	// The client can still learn the message wasn't accepted
+	tc.expect(451)
+	tc.expectClosed()
+	waitIdle(t, s)
+
+	if msgs := h.messages(); len(msgs) != 0 {
+		t.Fatalf("Expected no message to be delivered, got %d", len(msgs))
+	}
+}
+
+func TestShutdownWithOpenSession(t *testing.T) {
+	s := &Server{Hostname: "example.org", Logger: discardLogger{}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(ctx, l)
+	}()
+
+	tc := connect(t, l.Addr().String())
+	tc.cmd("EHLO client.example.com", 250)
+	cancel()
+
+	tc.expect(421)
+	tc.expectClosed()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return")
+	}
+}
@@ -0,0 +1,1395 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// extension is an ESMTP service extension advertised in reply to EHLO.
+// If params is set it returns the parameters advertised after the
+// keyword, and whether the extension is offered on this connection at
+// all.
+type extension struct {
+	keyword string
+	params  func(c *connection) (string, bool)
+}
+
+var extensions = []extension{
+	{keyword: "PIPELINING"},
+	{keyword: "8BITMIME"},
+	{keyword: "CHUNKING"},
+	{keyword: "SMTPUTF8"},
+	{keyword: "DSN"},
+	{keyword: "ENHANCEDSTATUSCODES"},
+	{keyword: "STARTTLS", params: func(c *connection) (string, bool) {
+		return "", c.server.TLSConfig != nil && !c.tls
+	}},
+	{keyword: "AUTH", params: func(c *connection) (string, bool) {
+		return c.authMechanismNames(), c.authAvailable()
+	}},
+	{keyword: "XCLIENT", params: func(c *connection) (string, bool) {
+		return xclientAttributes, c.xclientAllowed()
+	}},
+	{keyword: "SIZE", params: func(c *connection) (string, bool) {
+		if c.server.MaxMessageSize <= 0 {
+			return "", true
+		}
+
+		return strconv.Itoa(c.server.MaxMessageSize), true
+	}},
+}
+
+// header is one header field of a message, in the order it was
+// received.
+type header struct {
+	name  string
+	value string
+	// raw is the field as the client sent it, folding included but
+	// without the final line break.
+	raw string
+}
+
+type message struct {
+	// id identifies the transaction in logs and in the reply to DATA. It
+	// is assigned by MAIL.
+	id           string
+	clientDomain string
+	// remoteHost is the client's hostname, if it was looked up, and
+	// remoteHostVerified whether it was forward-confirmed.
+	remoteHost         string
+	remoteHostVerified bool
+	envelopeFrom       string
+	envelopeTo         []string
+	// rcpts are the recipients as the client gave them with RCPT,
+	// which Server.AliasResolver may have expanded into several
+	// entries of envelopeTo. rcptOf is the index in rcpts each one of
+	// envelopeTo came from.
+	rcpts  []string
+	rcptOf []int
+	// dsnRet, dsnEnvID and dsn are the DSN parameters of MAIL and of
+	// each recipient, in the order of envelopeTo, RFC 3461.
+	dsnRet     string
+	dsnEnvID   string
+	dsn        []dsnRecipient
+	atmHeaders []header
+	body       string
+	// date is the Date header as it was sent, and dateTime its parsed
+	// form. dateTime is the time the message was received if the header
+	// is missing or unparseable, and then dateSynthesized is set.
+	date            string
+	dateTime        time.Time
+	dateSynthesized bool
+	// received is when the end of the message's content arrived.
+	received time.Time
+	// subject, to and from have their encoded words decoded, the
+	// headers they came from are left as they were sent.
+	subject string
+	to      string
+	from    string
+
+	// smtputf8 is set when the client asked for SMTPUTF8, RFC 6531, so
+	// addresses and headers may be UTF-8.
+	smtputf8 bool
+	// spf is the result of checking envelopeFrom with SPF, if it was.
+	spf spfResult
+	// dkim has the result of verifying each DKIM-Signature, if they
+	// were.
+	dkim []dkimResult
+	// rejectedHeader is the first header Server.OnHeader rejected.
+	rejectedHeader string
+	// malformedHeader is the first header holding a bare CR, which
+	// other software might take as the start of another header.
+	malformedHeader string
+	// chunks is the content received so far with BDAT.
+	chunks *strings.Builder
+	// decodedBody is body with its Content-Transfer-Encoding undone.
+	decodedBody []byte
+	// parts is the MIME structure of the message. A message that isn't
+	// multipart has one part.
+	parts []part
+}
+
+// newMessage returns an empty transaction for a client that greeted
+// with clientDomain.
+func newMessage(clientDomain string) message {
+	return message{
+		clientDomain: clientDomain,
+	}
+}
+
+// newMessageID returns an identifier that is unique across restarts,
+// the time followed by random bits.
+func newMessageID() string {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Only the time is left, which is still unlikely to repeat
+		logError(err)
+	}
+
+	return fmt.Sprintf("%d.%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+func (c *connection) ehloLines(clientDomain string) []string {
+	lines := []string{c.server.hostname() + " Hello " + clientDomain}
+	for _, ext := range extensions {
+		line := ext.keyword
+		if ext.params != nil {
+			params, ok := ext.params(c)
+			if !ok {
+				continue
+			}
+
+			if params != "" {
+				line += " " + params
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// parseCommand splits a command line into its upper-cased verb and the
+// rest of the line. Commands that take no argument return an empty arg.
+func parseCommand(line string) (string, string) {
+	pieces := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	verb := strings.ToUpper(pieces[0])
+	if len(pieces) < 2 {
+		return verb, ""
+	}
+
+	return verb, strings.TrimSpace(pieces[1])
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// parsePath returns the address inside a MAIL FROM or RCPT TO path,
+// dropping the angle brackets, along with any trailing ESMTP
+// parameters keyed by their upper-cased name. A bracket without its
+// pair is left in, so the address doesn't validate.
+func parsePath(value string) (string, map[string]string) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	params := map[string]string{}
+	for _, field := range fields[1:] {
+		pieces := strings.SplitN(field, "=", 2)
+		key := strings.ToUpper(pieces[0])
+		if len(pieces) == 2 {
+			params[key] = pieces[1]
+		} else {
+			params[key] = ""
+		}
+	}
+
+	path := fields[0]
+	if strings.HasPrefix(path, "<") && strings.HasSuffix(path, ">") {
+		path = path[1 : len(path)-1]
+	}
+
+	return path, params
+}
+
+func isNullPath(value string) bool {
+	fields := strings.Fields(value)
+	return len(fields) > 0 && fields[0] == "<>"
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validAddress reports whether addr, stripped of its angle brackets,
+// is a syntactically valid mailbox.
+func validAddress(addr string) bool {
+	if addr == "" {
+		return false
+	}
+
+	parsed, err := mail.ParseAddress(addr)
+	return err == nil && parsed.Name == ""
+}
+
+// sessionState is how far a session has got through the SMTP command
+// sequence, RFC 5321 section 4.1.4.
+type sessionState int
+
+const (
+	// stateConnected is waiting for EHLO or HELO.
+	stateConnected sessionState = iota
+	// stateGreeted is ready to start a transaction with MAIL.
+	stateGreeted
+	// stateMail has a reverse-path and is waiting for RCPT.
+	stateMail
+	// stateRcpt has at least one recipient and may go on to DATA.
+	stateRcpt
+	// stateData is reading the message content.
+	stateData
+	// stateChunking has received some of the message content with BDAT
+	// and is waiting for the rest.
+	stateChunking
+)
+
+// command handles one SMTP verb, writing its own reply. An error means
+// the session cannot continue.
+type command func(c *connection, arg string) error
+
+var commands = map[string]command{
+	"EHLO":     (*connection).ehlo,
+	"HELO":     (*connection).helo,
+	"LHLO":     (*connection).lhlo,
+	"MAIL":     (*connection).mail,
+	"RCPT":     (*connection).rcpt,
+	"DATA":     (*connection).data,
+	"BDAT":     (*connection).bdat,
+	"RSET":     (*connection).rset,
+	"NOOP":     (*connection).noop,
+	"QUIT":     (*connection).quit,
+	"VRFY":     (*connection).vrfyCommand,
+	"EXPN":     (*connection).expnCommand,
+	"HELP":     (*connection).help,
+	"AUTH":     (*connection).authCommand,
+	"STARTTLS": (*connection).starttls,
+	"XCLIENT":  (*connection).xclient,
+	"XSTAT":    (*connection).xstat,
+	// Obsolete commands RFC 5321 appendix F deprecates, which old
+	// clients may still try
+	"SEND": (*connection).notImplemented,
+	"SOML": (*connection).notImplemented,
+	"SAML": (*connection).notImplemented,
+	"TURN": (*connection).notImplemented,
+}
+
+var errQuit = errors.New("Client quit")
+
+func (c *connection) notImplemented(arg string) error {
+	return c.reply(502, "5.5.1 Command not implemented")
+}
+
+func (c *connection) badSequence() error {
+	return c.reply(503, "5.5.1 Bad sequence of commands")
+}
+
+func (c *connection) greet(verb, clientDomain string) error {
+	// LMTP has LHLO in place of both, RFC 2033 section 4.1
+	if c.lmtp != (verb == "LHLO") {
+		return c.reply(500, "5.5.2 Command not recognized")
+	}
+
+	// A domain or address literal is required, RFC 5321 section 4.1.1.1
+	if clientDomain == "" {
+		return c.reply(501, "5.5.4 Syntax: "+verb+" hostname")
+	}
+
+	c.esmtp = verb != "HELO"
+	c.state = stateGreeted
+	if c.xclientHelo != "" {
+		clientDomain = c.xclientHelo
+	}
+	c.msg = newMessage(clientDomain)
+
+	// The EHLO reply is the one that goes without enhanced status
+	// codes, RFC 2034 section 3
+	if c.esmtp {
+		return c.writeReplyLines(250, c.ehloLines(clientDomain))
+	}
+
+	return c.reply(250, c.server.hostname()+" Hello "+clientDomain)
+}
+
+func (c *connection) ehlo(arg string) error {
+	return c.greet("EHLO", arg)
+}
+
+func (c *connection) helo(arg string) error {
+	return c.greet("HELO", arg)
+}
+
+func (c *connection) lhlo(arg string) error {
+	return c.greet("LHLO", arg)
+}
+
+func (c *connection) mail(arg string) error {
+	if c.state != stateGreeted {
+		return c.badSequence()
+	}
+
+	if !hasPrefixFold(arg, "FROM:") {
+		return c.reply(501, "5.5.2 Syntax error")
+	}
+
+	if c.mustStartTLS() {
+		return c.reply(530, "5.7.0 Must issue a STARTTLS command first")
+	}
+
+	if c.server.RequireAuth && c.authUser == "" {
+		return c.reply(530, "5.7.0 Authentication required")
+	}
+
+	from, params := parsePath(arg[len("FROM:"):])
+	// The null reverse-path <> is what bounces are sent from
+	if !(from == "" && isNullPath(arg[len("FROM:"):])) && !validAddress(from) {
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	_, utf8 := params["SMTPUTF8"]
+	if utf8 && (params["SMTPUTF8"] != "" || !c.esmtp) {
+		return c.reply(501, "5.5.4 Syntax error in SMTPUTF8 parameter")
+	}
+
+	if !utf8 && !isASCII(from) {
+		return c.reply(553, "5.6.7 Non-ASCII address requires SMTPUTF8")
+	}
+
+	ret, envID, err := parseDSNMail(params)
+	if err != nil || (ret != "" || envID != "") && !c.esmtp {
+		return c.reply(501, "5.5.4 Syntax error in DSN parameters")
+	}
+
+	if size, ok := params["SIZE"]; ok {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return c.reply(501, "5.5.4 Syntax error in SIZE parameter")
+		}
+
+		if n > c.server.maxMessageSize() {
+			return c.reply(552, "5.3.4 Message size exceeds fixed limit")
+		}
+	}
+
+	if c.server.CheckSPF {
+		spf := c.checkSPF(from)
+		c.logInfo("SPF result for <%s>: %s", from, spf)
+		if spf == spfFail && c.server.RejectSPFFail {
+			return c.reply(550, "5.7.23 SPF check failed for sender")
+		}
+
+		c.msg.spf = spf
+	}
+
+	c.msg.id = newMessageID()
+	c.msg.envelopeFrom = from
+	c.msg.remoteHost, c.msg.remoteHostVerified = c.remoteHost, c.remoteHostVerified
+	c.msg.smtputf8 = utf8
+	c.msg.dsnRet, c.msg.dsnEnvID = ret, envID
+	c.logInfo("Started message %s", c.msg.id)
+	c.state = stateMail
+	return c.reply(250, "2.1.0 OK")
+}
+
+func (c *connection) rcpt(arg string) error {
+	if c.state != stateMail && c.state != stateRcpt {
+		return c.badSequence()
+	}
+
+	if !hasPrefixFold(arg, "TO:") {
+		return c.reply(501, "5.5.2 Syntax error")
+	}
+
+	if max := c.server.MaxRecipients; max > 0 && len(c.msg.envelopeTo) >= max {
+		return c.reply(452, "4.5.3 Too many recipients")
+	}
+
+	to, params := parsePath(arg[len("TO:"):])
+	if !c.msg.smtputf8 && !isASCII(to) {
+		return c.reply(553, "5.6.7 Non-ASCII address requires SMTPUTF8")
+	}
+
+	dsn, err := parseDSNRcpt(params)
+	if err != nil || (dsn.notify != nil || dsn.orcpt != "") && !c.esmtp {
+		return c.reply(501, "5.5.4 Syntax error in DSN parameters")
+	}
+
+	// Postmaster without a domain must be accepted, RFC 5321 section
+	// 4.1.1.3
+	if !strings.EqualFold(to, "postmaster") && !validAddress(to) {
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	if !c.mayRelayTo(to) {
+		c.logInfo("Refused relaying <%s> to <%s>", c.msg.envelopeFrom, to)
+		return c.reply(550, "5.7.1 Relay access denied")
+	}
+
+	if g := c.server.Greylist; g != nil && !c.trusted {
+		ok, err := g.allow(remoteIP(c.clientAddr()), c.msg.envelopeFrom, to, time.Now())
+		if err != nil {
+			c.logError(err)
+			return c.reply(451, "4.3.0 Requested action aborted: local error in processing")
+		}
+
+		if !ok {
+			c.logInfo("Greylisted <%s> to <%s>", c.msg.envelopeFrom, to)
+			return c.reply(450, "4.7.1 Greylisted, try again later")
+		}
+	}
+
+	targets := []string{to}
+	if c.server.AliasResolver != nil {
+		expanded, code, text := c.expandAlias(to, &dsn)
+		if expanded == nil {
+			return c.reply(code, text)
+		}
+		targets = expanded
+	}
+
+	for _, target := range targets {
+		c.msg.envelopeTo = append(c.msg.envelopeTo, target)
+		c.msg.rcptOf = append(c.msg.rcptOf, len(c.msg.rcpts))
+		c.msg.dsn = append(c.msg.dsn, dsn)
+	}
+	c.msg.rcpts = append(c.msg.rcpts, to)
+	c.state = stateRcpt
+	return c.reply(250, "2.1.5 OK")
+}
+
+// expandAlias returns the addresses Server.AliasResolver rewrites the
+// recipient to into, and sets dsn's original recipient if it was an
+// alias. If there are none it returns the reply refusing the recipient
+// instead.
+func (c *connection) expandAlias(to string, dsn *dsnRecipient) ([]string, int, string) {
+	expanded, err := expandAlias(c.server.AliasResolver, to)
+	if err == errAliasLoop {
+		c.logInfo("Alias loop expanding <%s>", to)
+		return nil, 550, "5.4.6 Alias loop detected"
+	} else if err != nil {
+		c.logError(err)
+		return nil, 451, "4.3.0 Requested action aborted: local error in processing"
+	}
+
+	if len(expanded) == 0 {
+		return nil, 550, "5.1.1 No such user"
+	}
+
+	for _, target := range expanded {
+		if !strings.EqualFold(target, "postmaster") && !validAddress(target) ||
+			!c.msg.smtputf8 && !isASCII(target) {
+			c.logError(fmt.Errorf("Alias <%s> expands to invalid address <%s>", to, target))
+			return nil, 550, "5.1.3 Bad destination mailbox address"
+		}
+	}
+
+	if max := c.server.MaxRecipients; max > 0 && len(c.msg.envelopeTo)+len(expanded) > max {
+		return nil, 452, "4.5.3 Too many recipients"
+	}
+
+	if len(expanded) != 1 || expanded[0] != to {
+		c.logInfo("Expanded <%s> to <%s>", to, strings.Join(expanded, ">, <"))
+		// Reports about the targets should still name the recipient
+		// the client gave, RFC 3461 section 4.2
+		if dsn.orcpt == "" {
+			dsn.orcpt = "rfc822;" + to
+		}
+	}
+
+	return expanded, 0, ""
+}
+
+func (c *connection) rset(arg string) error {
+	if c.state != stateConnected {
+		c.state = stateGreeted
+		c.msg = newMessage(c.msg.clientDomain)
+	}
+
+	return c.reply(250, "OK")
+}
+
+func (c *connection) noop(arg string) error {
+	return c.reply(250, "OK")
+}
+
+func (c *connection) vrfyCommand(arg string) error {
+	return c.reply(c.vrfy(arg))
+}
+
+func (c *connection) expnCommand(arg string) error {
+	return c.replyLines(c.expn(arg))
+}
+
+func (c *connection) authCommand(arg string) error {
+	code, text, err := c.auth(arg)
+	if err != nil {
+		return err
+	}
+
+	return c.reply(code, text)
+}
+
+func (c *connection) help(arg string) error {
+	lines := []string{
+		"Supported commands:",
+		"EHLO HELO LHLO MAIL RCPT DATA BDAT",
+		"RSET NOOP QUIT VRFY EXPN HELP",
+		"STARTTLS AUTH",
+	}
+
+	// Only those who may use them learn about them
+	var trusted []string
+	if c.xclientAllowed() {
+		trusted = append(trusted, "XCLIENT")
+	}
+	if c.xstatAllowed() {
+		trusted = append(trusted, "XSTAT")
+	}
+	if len(trusted) > 0 {
+		lines = append(lines, strings.Join(trusted, " "))
+	}
+
+	return c.replyLines(214, append(lines, "End of HELP info"))
+}
+
+func (c *connection) quit(arg string) error {
+	err := c.reply(221, "Bye")
+	if err != nil {
+		return err
+	}
+
+	return errQuit
+}
+
+// mustStartTLS reports whether Server.RequireTLS holds the client back
+// until it has issued STARTTLS.
+func (c *connection) mustStartTLS() bool {
+	return c.server.RequireTLS && !c.tls && !c.lmtp
+}
+
+func (c *connection) starttls(arg string) error {
+	if c.server.TLSConfig == nil {
+		return c.reply(502, "5.5.1 Command not implemented")
+	}
+
+	if c.tls || !c.esmtp {
+		return c.badSequence()
+	}
+
+	err := c.reply(220, "Ready to start TLS")
+	if err == nil {
+		err = c.flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.handshake(tls.Server(c.conn, c.server.startTLSConfig))
+	if err != nil {
+		return err
+	}
+
+	// Anything the client sent before the handshake must not be treated
+	// as if it had arrived over the encrypted channel
+	c.discardBuffered()
+
+	// The client must start over with EHLO, RFC 3207 section 4.2
+	c.esmtp = false
+	c.state = stateConnected
+	c.msg = message{}
+	return nil
+}
+
+// handshake completes the TLS handshake on conn and makes it the
+// connection, recording what was negotiated.
+func (c *connection) handshake(conn *tls.Conn) error {
+	if c.server.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout))
+	}
+
+	err := conn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	c.conn = conn
+	c.tls = true
+	c.tlsState = &state
+	c.logInfo("TLS handshake complete: %s", describeTLS(state))
+	return nil
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// describeTLS names the version and cipher suite of a TLS connection,
+// e.g. "TLSv1.3 TLS_AES_128_GCM_SHA256".
+func describeTLS(state tls.ConnectionState) string {
+	version, ok := tlsVersionNames[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+
+	return version + " " + tls.CipherSuiteName(state.CipherSuite)
+}
+
+// headerSize is how many bytes the header fields took up as they were
+// sent, not counting the empty line that may end them.
+func (m *message) headerSize() int {
+	size := 0
+	for _, h := range m.atmHeaders {
+		size += len(h.raw) + len("\r\n")
+	}
+
+	return size
+}
+
+// header returns the value of the first header called name, compared
+// case insensitively.
+func (m *message) header(name string) string {
+	for _, h := range m.atmHeaders {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+
+	return ""
+}
+
+// headerValues returns the values of every header called name, in
+// order.
+func (m *message) headerValues(name string) []string {
+	var values []string
+	for _, h := range m.atmHeaders {
+		if strings.EqualFold(h.name, name) {
+			values = append(values, h.value)
+		}
+	}
+
+	return values
+}
+
+// decodedValue is the value with any RFC 2047 encoded words, like
+// =?UTF-8?Q?caf=C3=A9?=, decoded.
+func (h header) decodedValue() string {
+	return decodeHeaderValue(h.value)
+}
+
+func (m *message) addHeader(h header) {
+	m.atmHeaders = append(m.atmHeaders, h)
+
+	// Only the first of headers that should appear once counts
+	switch strings.ToUpper(h.name) {
+	case "SUBJECT":
+		if m.subject == "" {
+			m.subject = h.decodedValue()
+		}
+	case "TO":
+		if m.to == "" {
+			m.to = h.decodedValue()
+		}
+	case "FROM":
+		if m.from == "" {
+			m.from = h.decodedValue()
+		}
+	case "DATE":
+		if m.date == "" {
+			m.date = h.value
+		}
+	}
+}
+
+// parseDate sets dateTime from the Date header, RFC 5322 section 3.3,
+// or from the time the message was received.
+func (m *message) parseDate() {
+	if m.date != "" {
+		t, err := mail.ParseDate(m.date)
+		if err == nil {
+			m.dateTime = withObsoleteZone(t)
+			return
+		}
+	}
+
+	m.dateTime = m.received
+	m.dateSynthesized = true
+}
+
+// obsoleteZones are the offsets in hours of the zone names RFC 5322
+// section 4.3 still allows.
+var obsoleteZones = map[string]int{
+	"UT": 0, "GMT": 0,
+	"EST": -5, "EDT": -4,
+	"CST": -6, "CDT": -5,
+	"MST": -7, "MDT": -6,
+	"PST": -8, "PDT": -7,
+}
+
+// withObsoleteZone corrects the offset of a time parsed with a zone
+// name, which is taken as UTC unless it is the local zone's.
+func withObsoleteZone(t time.Time) time.Time {
+	name, offset := t.Zone()
+	hours, ok := obsoleteZones[name]
+	if !ok || offset != 0 {
+		return t
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(),
+		t.Nanosecond(), time.FixedZone(name, hours*60*60))
+}
+
+// protocol names the protocol the message was received with, for the
+// Received header, RFC 3848.
+func (c *connection) protocol() string {
+	if !c.esmtp {
+		return "SMTP"
+	}
+
+	// RFC 6531 section 3.7.4
+	protocol := "ESMTP"
+	switch {
+	case c.lmtp && c.msg.smtputf8:
+		protocol = "UTF8LMTP"
+	case c.lmtp:
+		protocol = "LMTP"
+	case c.msg.smtputf8:
+		protocol = "UTF8SMTP"
+	}
+	if c.tls {
+		protocol += "S"
+	}
+	if c.authUser != "" {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+// receivedHeader builds the Received trace field recording how this
+// server got the message, RFC 5321 section 4.4.
+func (c *connection) receivedHeader() header {
+	from := c.msg.clientDomain
+	if ip := remoteIP(c.clientAddr()); ip != "" {
+		from += " (" + strings.TrimSpace(c.remoteHost+" ["+ip+"]") + ")"
+	}
+
+	with := c.protocol()
+	if c.tlsState != nil {
+		with += " (" + describeTLS(*c.tlsState) + ")"
+	}
+
+	value := fmt.Sprintf("from %s\r\n\tby %s with %s id %s",
+		from, c.server.hostname(), with, c.msg.id)
+	// Naming the recipient only when there is one doesn't give away the
+	// rest of the list
+	if len(c.msg.envelopeTo) == 1 {
+		value += "\r\n\tfor <" + c.msg.envelopeTo[0] + ">"
+	}
+	value += ";\r\n\t" + c.msg.received.Format(time.RFC1123Z)
+
+	return header{
+		name:  "Received",
+		value: strings.ReplaceAll(value, "\r\n\t", " "),
+		raw:   "Received: " + value,
+	}
+}
+
+// stampHeaders adds the headers this server is responsible for to a
+// message whose own headers have been read.
+func (c *connection) stampHeaders(m *message) {
+	if c.server.SynthesizeHeaders {
+		c.synthesizeHeaders(m)
+	}
+
+	// Forged results must go even when no check ran that would replace
+	// them, RFC 8601 section 5
+	if c.server.CheckSPF || c.server.VerifyDKIM {
+		m.removeAuthResults(c.server.hostname())
+	}
+
+	// Trace fields go on top, RFC 5321 section 4.4
+	stamped := []header{c.receivedHeader()}
+	if h, ok := c.authResultsHeader(m); ok {
+		stamped = append(stamped, h)
+	}
+
+	m.atmHeaders = append(stamped, m.atmHeaders...)
+}
+
+// synthesizeHeaders adds the Date and From headers RFC 5322 section
+// 3.6 requires, and the Message-ID it recommends, if the client left
+// them out.
+func (c *connection) synthesizeHeaders(m *message) {
+	if m.header("Message-ID") == "" {
+		value := "<" + m.id + "@" + c.server.hostname() + ">"
+		m.addHeader(header{name: "Message-ID", value: value, raw: "Message-ID: " + value})
+		c.log(LevelDebug, "Added a Message-ID header to message "+m.id)
+	}
+
+	if m.header("Date") == "" {
+		value := m.received.Format(time.RFC1123Z)
+		m.addHeader(header{name: "Date", value: value, raw: "Date: " + value})
+		c.log(LevelDebug, "Added a Date header to message "+m.id)
+	}
+
+	if m.header("From") == "" {
+		from := c.authUser
+		if from != "" && !strings.Contains(from, "@") {
+			from += "@" + c.server.hostname()
+		}
+		if from == "" {
+			from = m.envelopeFrom
+		}
+
+		// There is no one to name for a bounce from an anonymous client
+		if from != "" {
+			m.addHeader(header{name: "From", value: from, raw: "From: " + from})
+			c.log(LevelDebug, "Added a From header to message "+m.id)
+		}
+	}
+}
+
+// deliver hands the complete message in c.msg to the server's handler,
+// replies with the outcome and resets the transaction.
+func (c *connection) deliver() error {
+	msg := &c.msg
+	msg.received = time.Now()
+	c.logInfo("Got body of message %s (%d bytes)", msg.id, len(msg.body))
+	c.server.Metrics.messageReceived(len(msg.body))
+	if msg.rejectedHeader != "" {
+		c.logInfo("Rejected message %s for its %s header", msg.id, msg.rejectedHeader)
+		return c.refuseMessage(550, "5.7.1 Message rejected")
+	}
+
+	if msg.malformedHeader != "" {
+		c.logInfo("Rejected message %s for a bare CR in its %s header", msg.id, msg.malformedHeader)
+		return c.refuseMessage(550, "5.6.0 Malformed header")
+	}
+
+	if c.server.VerifyDKIM {
+		c.verifyDKIM(msg)
+	}
+
+	msg.parseDate()
+	if msg.dateSynthesized {
+		c.log(LevelDebug, fmt.Sprintf("Message %s has no valid Date, using the time it was received", msg.id))
+	}
+
+	c.stampHeaders(msg)
+	c.decodeBody(msg)
+	c.parseParts(msg)
+	// Bodies are private and large, so only log them when debugging
+	c.log(LevelDebug, "Message:\n"+msg.body+"\n")
+
+	if c.server.Filter != nil {
+		code, text := c.server.Filter(msg)
+		switch {
+		case code == 0 || code >= 200 && code < 300:
+		case code >= 400 && code < 600:
+			c.logInfo("Filter refused message %s: %d %s", msg.id, code, text)
+			return c.refuseMessage(code, strings.Join(strings.Fields(text), " "))
+		default:
+			c.logError(fmt.Errorf("Filter returned invalid reply code %d", code))
+			return c.refuseMessage(451, "4.3.0 Requested action aborted: local error in processing")
+		}
+	}
+
+	if c.lmtp {
+		return c.deliverLMTP(msg)
+	}
+
+	code, text := c.deliveryReply(msg, c.server.handler().Handle(c.ctx, msg))
+	c.state = stateGreeted
+	c.msg = newMessage(msg.clientDomain)
+	return c.reply(code, text)
+}
+
+// refuseMessage resets the transaction and replies that the message
+// was not accepted, once for every recipient in LMTP.
+func (c *connection) refuseMessage(code int, text string) error {
+	recipients := 1
+	if c.lmtp {
+		recipients = len(c.msg.rcpts)
+	}
+
+	c.state = stateGreeted
+	c.msg = newMessage(c.msg.clientDomain)
+	for i := 0; i < recipients; i++ {
+		err := c.reply(code, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverLMTP hands msg to the handler and replies once for every
+// recipient, RFC 2033 section 4.2, in the order they were given.
+func (c *connection) deliverLMTP(msg *message) error {
+	results := map[string]error{}
+	if rh, ok := c.server.handler().(RecipientHandler); ok {
+		for _, to := range msg.envelopeTo {
+			results[to] = errors.New("No result for recipient " + to)
+		}
+
+		for _, result := range rh.HandleRecipients(c.ctx, msg) {
+			results[result.Recipient] = result.Err
+		}
+	} else {
+		err := c.server.handler().Handle(c.ctx, msg)
+		for _, to := range msg.envelopeTo {
+			results[to] = err
+		}
+	}
+
+	// A recipient expanded into several addresses gets the reply for
+	// the first of them that failed
+	codes := make([]int, len(msg.rcpts))
+	texts := make([]string, len(msg.rcpts))
+	for i, to := range msg.envelopeTo {
+		code, text := c.deliveryReply(msg, results[to])
+		rcpt := msg.rcptOf[i]
+		if codes[rcpt] == 0 || codes[rcpt] < 400 && code >= 400 {
+			codes[rcpt], texts[rcpt] = code, text+" <"+msg.rcpts[rcpt]+">"
+		}
+	}
+
+	c.state = stateGreeted
+	c.msg = newMessage(msg.clientDomain)
+	for i := range codes {
+		err := c.reply(codes[i], texts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliveryReply is the reply for the outcome of handing msg to the
+// handler.
+func (c *connection) deliveryReply(msg *message, err error) (int, string) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.logError(err)
+		return smtpErr.Code, smtpErr.Message
+	} else if err != nil {
+		c.logError(err)
+		return 451, "4.3.0 Requested action aborted: local error in processing"
+	}
+
+	return 250, "2.0.0 Ok: queued as " + msg.id
+}
+
+// headerBlock accumulates header lines into a message, unfolding
+// continuation lines, RFC 5322 section 2.2.3.
+type headerBlock struct {
+	m                *message
+	name, value, raw string
+	// onHeader is Server.OnHeader.
+	onHeader func(name, value string) (string, bool)
+	// count and size are how many fields and bytes were added.
+	count, size int
+}
+
+// add takes the next line of the header block. It returns false if the
+// line isn't a header at all, which means the client sent the body
+// without a header block, or without ending it.
+func (hb *headerBlock) add(line string) bool {
+	hb.size += len(line) + len("\r\n")
+	// Line endings are gone, so any CR or LF left is a bare one, RFC
+	// 5322 section 2.2
+	malformed := strings.ContainsAny(line, "\r\n")
+	if line != "" && (line[0] == ' ' || line[0] == '\t') {
+		// There is nothing to continue at the very start, and the line
+		// would be lost
+		if hb.name == "" {
+			return false
+		}
+
+		// Unfolding only removes the line break
+		hb.value += line
+		hb.raw += "\r\n" + line
+		if malformed && hb.m.malformedHeader == "" {
+			hb.m.malformedHeader = hb.name
+		}
+		return true
+	}
+
+	hb.flush()
+
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 || strings.ContainsAny(line[:colon], " \t") {
+		return false
+	}
+
+	hb.name, hb.value, hb.raw = line[:colon], line[colon+1:], line
+	hb.count++
+	if malformed && hb.m.malformedHeader == "" {
+		hb.m.malformedHeader = hb.name
+	}
+	return true
+}
+
+// headerTooLarge reports whether hb is over the server's header limits.
+func (c *connection) headerTooLarge(hb *headerBlock) bool {
+	max, maxSize := c.server.MaxHeaders, c.server.MaxHeaderSize
+	return max > 0 && hb.count > max || maxSize > 0 && hb.size > maxSize
+}
+
+// headerLimit is how many more bytes the header block may take up as
+// it is read, and the error for going past that: MaxHeaderSize or the
+// message size, whichever runs out first.
+func (c *connection) headerLimit(hb *headerBlock) (int, error) {
+	max, err := c.server.maxMessageSize()-hb.size, errMessageTooLarge
+	if c.server.MaxHeaderSize > 0 && c.server.MaxHeaderSize-hb.size < max {
+		max, err = c.server.MaxHeaderSize-hb.size, errHeaderTooLarge
+	}
+
+	return max, err
+}
+
+// headerOverLimit replies to a header block that went past the limit
+// err stands for, and returns err.
+func (c *connection) headerOverLimit(err error) error {
+	if err == errMessageTooLarge {
+		c.reply(552, "5.3.4 Message size exceeds fixed limit")
+	} else {
+		c.reply(552, "5.3.4 Header exceeds fixed limit")
+	}
+
+	return err
+}
+
+func (hb *headerBlock) flush() {
+	if hb.name == "" {
+		return
+	}
+
+	h := header{name: hb.name, value: strings.TrimSpace(hb.value), raw: hb.raw}
+	hb.name = ""
+	if hb.onHeader != nil {
+		value, reject := hb.onHeader(h.name, h.value)
+		if reject && hb.m.rejectedHeader == "" {
+			hb.m.rejectedHeader = h.name
+		}
+
+		// A rewritten header is sent unfolded, and without line breaks
+		// that would let it turn into more than one
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		if value != h.value {
+			h.value, h.raw = value, h.name+": "+value
+		}
+	}
+
+	hb.m.addHeader(h)
+}
+
+// readHeaders reads the header block of a message into m. It returns
+// false if the data ended before any body. A line that turns out to
+// start the body instead of a header is returned with its line ending,
+// see readToEndOfBody.
+func (c *connection) readHeaders(m *message) (string, bool, error) {
+	hb := headerBlock{m: m, onHeader: c.server.OnHeader}
+	for {
+		// Header lines aren't held to the command line length limit,
+		// only to what is left of MaxHeaderSize and the message size.
+		// The line ending the header block or the data still fits.
+		max, limitErr := c.headerLimit(&hb)
+		if max < len(".\r\n") {
+			max = len(".\r\n")
+		}
+
+		line, crlf, err := c.readLineEnding(max)
+		if err == errLineTooLong {
+			return "", false, c.headerOverLimit(limitErr)
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		// Only CRLF.CRLF ends the data, as in readToEndOfBody
+		if line == "." && crlf {
+			hb.flush()
+			return "", false, nil
+		}
+
+		if line == "" {
+			hb.flush()
+			return "", true, nil
+		}
+
+		ok := hb.add(line)
+		if ok && c.headerTooLarge(&hb) {
+			return "", false, c.headerOverLimit(errHeaderTooLarge)
+		}
+		if ok && hb.size > c.server.maxMessageSize() {
+			return "", false, c.headerOverLimit(errMessageTooLarge)
+		}
+
+		if !ok {
+			// Treat it as the start of the body instead, as it was sent
+			ending := "\n"
+			if crlf {
+				ending = "\r\n"
+			}
+
+			return line + ending, true, nil
+		}
+	}
+}
+
+// parseHeaders reads the header block at the start of data into m, and
+// returns the body that follows it. It fails if the header block is
+// over the server's limits.
+func (c *connection) parseHeaders(m *message, data string) (string, error) {
+	hb := headerBlock{m: m, onHeader: c.server.OnHeader}
+	for data != "" {
+		line, rest := data, ""
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			line, rest = data[:i], data[i+1:]
+		}
+		line = strings.TrimSuffix(line, "\r")
+
+		if line == "" {
+			hb.flush()
+			return rest, nil
+		}
+
+		if !hb.add(line) {
+			return data, nil
+		}
+
+		if c.headerTooLarge(&hb) {
+			return "", errHeaderTooLarge
+		}
+
+		data = rest
+	}
+
+	hb.flush()
+	return "", nil
+}
+
+func (c *connection) data(arg string) error {
+	// RFC 5321 section 3.3
+	if c.state == stateMail && len(c.msg.envelopeTo) == 0 {
+		return c.reply(554, "5.5.1 No valid recipients")
+	}
+
+	if c.state != stateRcpt {
+		return c.badSequence()
+	}
+
+	err := c.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	if err != nil {
+		return err
+	}
+
+	c.state = stateData
+	c.logInfo("Done SMTP headers, reading ARPA text message headers")
+
+	msg := &c.msg
+	first, hasBody, err := c.readHeaders(msg)
+	if err != nil {
+		return c.abortData(err)
+	}
+
+	c.logInfo("Done ARPA text message headers, reading body")
+
+	if hasBody {
+		max := c.server.maxMessageSize() - msg.headerSize()
+		if first == "" {
+			// The header block ended with an empty line
+			max -= len("\r\n")
+		}
+
+		msg.body, err = c.readToEndOfBody(first, max)
+	}
+	if err == errMessageTooLarge {
+		c.reply(552, "5.3.4 Message size exceeds fixed limit")
+		return err
+	}
+	if err != nil {
+		return c.abortData(err)
+	}
+
+	return c.deliver()
+}
+
+// abortData throws away a message whose content could not be read in
+// full because of err. Whatever was buffered is not a message and is
+// never delivered.
+func (c *connection) abortData(err error) error {
+	c.discardBuffered()
+	c.msg = newMessage(c.msg.clientDomain)
+	if err != io.EOF {
+		return err
+	}
+
+	// The client may only have closed its side of the connection, so
+	// it could still learn that the message was not accepted
+	c.reply(451, "4.3.0 Requested action aborted: message incomplete")
+	return errIncompleteData
+}
+
+// greeting is the text of the 220 greeting after the host name, which
+// has to come first, RFC 5321 section 4.3.1. It is a single line, even
+// when Server.Greeting isn't.
+func (c *connection) greeting() string {
+	greeting := strings.Join(strings.Fields(c.server.Greeting), " ")
+	if greeting == "" && c.lmtp {
+		return "LMTP ready"
+	}
+
+	if greeting == "" {
+		return "ESMTP ready"
+	}
+
+	return greeting
+}
+
+// handle runs the session until the client quits, the connection
+// fails or ctx is done.
+func (c *connection) handle(ctx context.Context) {
+	// c.conn is replaced on STARTTLS, so don't bind it now
+	defer func() {
+		c.flush()
+		c.conn.Close()
+	}()
+	c.logInfo("Connection accepted")
+
+	// Cancelling ctx interrupts a blocked read like a shutdown does, see
+	// read. A TLS connection passes deadlines on to the one beneath, so
+	// the original connection will do.
+	c.ctx = ctx
+	c.r = bufio.NewReader(connReader{c})
+	conn := c.conn
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	// Implicit TLS connections would otherwise complete the handshake on
+	// the first write, finishing it here means what was negotiated is
+	// known from the start
+	if tlsConn, ok := c.conn.(*tls.Conn); ok && c.tlsState == nil {
+		err := c.handshake(tlsConn)
+		if err != nil {
+			c.logError(err)
+			return
+		}
+	}
+
+	if c.server.OnConnect != nil {
+		accept, code, msg := c.server.OnConnect(c.conn.RemoteAddr())
+		if !accept {
+			if code < 400 || code > 599 {
+				code = 554
+			}
+
+			// The reply has to stay on one line
+			msg = strings.Join(strings.Fields(msg), " ")
+			if msg == "" {
+				msg = "Access denied"
+			}
+
+			c.reject(code, msg)
+			return
+		}
+	}
+
+	if c.server.LookupRemoteHost {
+		c.lookupRemoteHost()
+	}
+
+	err := c.reply(220, c.server.hostname()+" "+c.greeting())
+	if err != nil {
+		c.logError(err)
+		return
+	}
+
+	for count := 1; ; count++ {
+		line, err := c.readLine()
+		if err != nil {
+			c.logError(err)
+			return
+		}
+
+		if c.server.MaxCommands > 0 && count > c.server.MaxCommands {
+			c.logInfo("Too many commands, closing connection")
+			c.reply(421, "4.7.0 Too many commands, closing connection")
+			return
+		}
+
+		// A blank line is no command at all, not one we don't know
+		if strings.TrimSpace(line) == "" {
+			err = c.reply(500, "5.5.2 Error: bad syntax")
+			if err != nil {
+				c.logError(err)
+				return
+			}
+
+			continue
+		}
+
+		// The line ending is gone, so any CR left is a bare one that
+		// could split a value in two where it is written out again,
+		// e.g. in the Received header or the log
+		if strings.ContainsAny(line, "\r\n") {
+			c.logInfo("Refused a command with a bare CR")
+			err = c.reply(501, "5.5.2 Syntax error, bare CR in command")
+			if err != nil {
+				c.logError(err)
+				return
+			}
+
+			continue
+		}
+
+		verb, arg := parseCommand(line)
+		command := Field{Key: FieldCommand, Value: verb}
+		if verb == "AUTH" {
+			// Don't log credentials sent as an initial response
+			c.log(LevelInfo, "Got command: AUTH", command)
+		} else {
+			c.log(LevelInfo, "Got command: "+line, command)
+		}
+
+		c.server.Metrics.command(verb)
+		cmd, ok := commands[verb]
+		if !ok {
+			err = c.reply(500, "5.5.2 Command not recognized")
+		} else {
+			err = cmd(c, arg)
+		}
+
+		if err == errQuit {
+			c.logInfo("Connection closed")
+			return
+		}
+
+		if err != nil {
+			c.logError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,1267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn is a net.Conn remembering everything written to it,
+// one entry for every call to Write.
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []string
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.mu.Lock()
+	rc.writes = append(rc.writes, string(b))
+	rc.mu.Unlock()
+	return rc.Conn.Write(b)
+}
+
+// takeWrites returns what was written since it was last called.
+func (rc *recordingConn) takeWrites() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	writes := rc.writes
+	rc.writes = nil
+	return writes
+}
+
+// pipeSession runs a session with s on one end of a net.Pipe, whose
+// writes are recorded, and returns a client on the other end.
+func pipeSession(t *testing.T, s *Server) (*testClient, *recordingConn) {
+	t.Helper()
+
+	if s.Hostname == "" {
+		s.Hostname = "example.org"
+	}
+	if s.Logger == nil {
+		s.Logger = discardLogger{}
+	}
+
+	server, client := net.Pipe()
+	rc := &recordingConn{Conn: server}
+	c := &connection{server: s, conn: rc, id: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.handle(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+
+	client.SetDeadline(time.Now().Add(testTimeout))
+	return &testClient{t: t, conn: client, r: bufio.NewReader(client)}, rc
+}
+
+func TestPipelining(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := dial(t, addr)
+	// The whole session at once, two transactions included
+	tc.send(
+		"EHLO client.example.com",
+		"MAIL FROM:<alice@example.com>",
+		"RCPT TO:<bob@example.org>",
+		"RCPT TO:<carol@example.org>",
+		"DATA",
+		"Subject: One",
+		"",
+		"First",
+		".",
+		"MAIL FROM:<dave@example.com>",
+		"RCPT TO:<nobody@elsewhere.example>",
+		"RCPT TO:<bob@example.org>",
+		"BDAT 24 LAST",
+		"Subject: Two\r\n\r\nSecond",
+		"QUIT",
+	)
+
+	tc.expect(220)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(354)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(550)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(221)
+	tc.expectClosed()
+
+	msgs := h.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	if msgs[0].subject != "One" || msgs[0].body != "First" || strings.Join(msgs[0].envelopeTo, ",") != "bob@example.org,carol@example.org" {
+		t.Fatalf("Unexpected first message %q to %q: %q", msgs[0].subject, msgs[0].envelopeTo, msgs[0].body)
+	}
+
+	if msgs[1].subject != "Two" || msgs[1].body != "Second" || strings.Join(msgs[1].envelopeTo, ",") != "bob@example.org" {
+		t.Fatalf("Unexpected second message %q to %q: %q", msgs[1].subject, msgs[1].envelopeTo, msgs[1].body)
+	}
+}
+
+func TestPipelinedRepliesGoOutTogether(t *testing.T) {
+	tc, rc := pipeSession(t, &Server{})
+	tc.expect(220)
+	tc.cmd("EHLO client.example.com", 250)
+	rc.takeWrites()
+
+	tc.send("MAIL FROM:<alice@example.com>", "RCPT TO:<bob@example.org>", "RCPT TO:<carol@example.org>", "DATA")
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(354)
+
+	writes := rc.takeWrites()
+	if len(writes) != 1 {
+		t.Fatalf("Expected the replies in a single write, got %q", writes)
+	}
+
+	tc.send("Subject: Hi", "", "Hello", ".", "QUIT")
+	tc.expect(250)
+	tc.expect(221)
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line, verb, arg string
+	}{
+		{"NOOP", "NOOP", ""},
+		{"quit", "QUIT", ""},
+		{"  RSET  ", "RSET", ""},
+		{"MAIL FROM:<alice@example.com>", "MAIL", "FROM:<alice@example.com>"},
+		{"rcpt   TO:<bob@example.org> ", "RCPT", "TO:<bob@example.org>"},
+		{"MAIL:", "MAIL:", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		verb, arg := parseCommand(test.line)
+		if verb != test.verb || arg != test.arg {
+			t.Errorf("%q: expected %q, %q, got %q, %q", test.line, test.verb, test.arg, verb, arg)
+		}
+	}
+}
+
+func TestCommandsWithoutArgument(t *testing.T) {
+	tests := []struct {
+		line string
+		code int
+	}{
+		{"NOOP", 250},
+		{"RSET", 250},
+		{"HELP", 214},
+		{"MAIL", 501},
+		{"MAIL FROM", 501},
+		{"MAIL FROM:", 501},
+		{"MAIL:", 500},
+		{"RCPT", 503},
+		{"DATA", 503},
+		{"BDAT", 501},
+		{"VRFY", 501},
+		{"EXPN", 502},
+		{"AUTH", 502},
+		{"STARTTLS", 502},
+		{":", 500},
+	}
+
+	s := &Server{}
+	addr := startServer(t, s)
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	for _, test := range tests {
+		tc.cmd(test.line, test.code)
+		tc.cmd("NOOP", 250)
+	}
+
+	// And in a transaction
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT", 501)
+	tc.cmd("RCPT TO", 501)
+	tc.cmd("RCPT TO:", 501)
+	tc.cmd("RCPT:", 500)
+	tc.cmd("QUIT", 221)
+	tc.expectClosed()
+	waitIdle(t, s)
+}
+
+func TestQuitInTransaction(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	// Before HELO
+	tc := connect(t, addr)
+	tc.cmd("quit", 221)
+	tc.expectClosed()
+
+	// Before DATA, the transaction is thrown away
+	tc = connect(t, addr)
+	tc.startMail()
+	tc.cmd("QUIT", 221)
+	tc.expectClosed()
+
+	// After a message, the next commands are never read
+	tc = connect(t, addr)
+	tc.startMail()
+	tc.cmd("DATA", 354)
+	tc.send("Subject: Hi", "", "Hello", ".", "QUIT", "NOOP")
+	tc.expect(250)
+	tc.expect(221)
+	tc.expectClosed()
+
+	waitIdle(t, s)
+	if msgs := h.messages(); len(msgs) != 1 {
+		t.Fatalf("Expected 1 message to be delivered, got %d", len(msgs))
+	}
+}
+
+func TestSizeExtension(t *testing.T) {
+	s := &Server{MaxMessageSize: 1000}
+	addr := startServer(t, s)
+
+	tc, extensions := ehlo(t, addr)
+	if !containsLine(extensions, "SIZE 1000") {
+		t.Fatalf("Expected SIZE 1000 to be advertised, got %q", extensions)
+	}
+
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=99999999", 552)
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=1001", 552)
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=x", 501)
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=1000", 250)
+	tc.cmd("RSET", 250)
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=10", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.cmd("QUIT", 221)
+
+	// Without a limit SIZE is advertised on its own
+	tc, extensions = ehlo(t, startServer(t, &Server{}))
+	if !containsLine(extensions, "SIZE") {
+		t.Fatalf("Expected SIZE to be advertised, got %q", extensions)
+	}
+	tc.cmd("MAIL FROM:<alice@example.com> SIZE=99999999", 250)
+	tc.cmd("QUIT", 221)
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	const max = 200
+	// content returns a message of exactly size bytes as sent, ending
+	// in CRLF
+	content := func(size int) string {
+		header := "Subject: Size\r\n\r\n"
+		body := strings.Repeat("x", 50) + "\r\n"
+		for len(header)+len(body) < size {
+			body = "." + body
+		}
+		return header + body
+	}
+	if len(content(max)) != max {
+		t.Fatalf("Got a message of %d bytes", len(content(max)))
+	}
+
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"at the limit", content(max), true},
+		{"over the limit", content(max + 1), false},
+		{"header only at the limit", "Subject: " + strings.Repeat("x", max-len("Subject: \r\n")) + "\r\n", true},
+		{"header only over the limit", "Subject: " + strings.Repeat("x", max-len("Subject: \r\n")+1) + "\r\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &collectHandler{}
+			s := &Server{MaxMessageSize: max, Handler: h}
+			addr := startServer(t, s)
+
+			// DATA counts the message without the periods stuffed in
+			code := 552
+			if test.ok {
+				code = 250
+			}
+			tc := connect(t, addr)
+			tc.startMail()
+			tc.cmd("DATA", 354)
+			tc.sendRaw(strings.Replace(test.data, "\r\n.", "\r\n..", -1) + ".\r\n")
+			tc.expect(code)
+			if !test.ok {
+				// The rest of the message is never read
+				tc.expectClosed()
+			}
+
+			tc = connect(t, addr)
+			tc.startMail()
+			tc.sendRaw("BDAT " + strconv.Itoa(len(test.data)) + " LAST\r\n" + test.data)
+			tc.expect(code)
+			tc.cmd("MAIL FROM:<alice@example.com> SIZE="+strconv.Itoa(len(test.data)), code)
+			tc.cmd("QUIT", 221)
+		})
+	}
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestRequireAuth(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	h := &collectHandler{}
+	s := &Server{
+		Handler:       h,
+		RequireAuth:   true,
+		Authenticator: MemoryAuthenticator{"alice": "secret"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	addr := startServer(t, s)
+
+	tc, extensions := ehlo(t, addr)
+	if containsPrefix(extensions, "AUTH") {
+		t.Fatalf("Expected no AUTH before STARTTLS, got %q", extensions)
+	}
+	tc.cmd("MAIL FROM:<alice@example.com>", 530)
+	tc.cmd("AUTH PLAIN AGFsaWNlAHNlY3JldA==", 538)
+
+	tc.startTLS(&tls.Config{InsecureSkipVerify: true})
+	extensions = tc.cmd("EHLO client.example.com", 250)[1:]
+	if !containsPrefix(extensions, "AUTH") {
+		t.Fatalf("Expected AUTH after STARTTLS, got %q", extensions)
+	}
+	tc.cmd("MAIL FROM:<alice@example.com>", 530)
+	// alice, wrong password
+	tc.cmd("AUTH PLAIN AGFsaWNlAHdyb25n", 535)
+	tc.cmd("MAIL FROM:<alice@example.com>", 530)
+
+	// alice, secret
+	tc.cmd("AUTH PLAIN AGFsaWNlAHNlY3JldA==", 235)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message to be delivered, got %d", len(msgs))
+	}
+}
+
+func containsPrefix(lines []string, prefix string) bool {
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestBareLF(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.sendRaw("EHLO client.example.com\n")
+	tc.expect(250)
+	tc.sendRaw("MAIL FROM:<alice@example.com>\nRCPT TO:<bob@example.org>\r\nDATA\n")
+	tc.expect(250)
+	tc.expect(250)
+	tc.expect(354)
+
+	// Header lines may end in a bare LF too, body lines are kept as
+	// they were sent
+	tc.sendRaw("Subject: Hi\nTo: bob@example.org\r\n\nHello\nthere\r\n.\r\n")
+	tc.expect(250)
+	tc.sendRaw("QUIT\n")
+	tc.expect(221)
+	tc.expectClosed()
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message to be delivered, got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if m.subject != "Hi" || m.to != "bob@example.org" || m.body != "Hello\nthere" {
+		t.Fatalf("Unexpected message %q to %q: %q", m.subject, m.to, m.body)
+	}
+}
+
+func TestLineTooLong(t *testing.T) {
+	s := &Server{MaxLineLength: 512}
+	addr := startServer(t, s)
+
+	// 512 bytes including CRLF
+	tc := connect(t, addr)
+	tc.cmd("NOOP "+strings.Repeat("x", 512-len("NOOP \r\n")), 250)
+	tc.cmd("NOOP "+strings.Repeat("x", 512-len("NOOP \r\n")+1), 500)
+	tc.expectClosed()
+
+	// A line that never ends is cut off, not buffered
+	tc = connect(t, addr)
+	go func() {
+		chunk := strings.Repeat("x", 64<<10)
+		for i := 0; i < 1024; i++ {
+			_, err := io.WriteString(tc.conn, chunk)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	tc.expect(500)
+	waitIdle(t, s)
+}
+
+func TestFoldedHeaders(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.sendMessage("Subject: A long\r\n subject\r\n\tline\r\nTo:bob@example.org\r\nX-Empty:\r\nNot a header\r\n\r\nHello\r\n", 250)
+	tc.startMail()
+	tc.sendMessage(" Starts folded\r\nSubject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if m.subject != "A long subject\tline" || m.header("To") != "bob@example.org" {
+		t.Fatalf("Unexpected headers %q", m.atmHeaders)
+	}
+	// A line that isn't a header starts the body
+	if m.body != "Not a header\r\n\r\nHello" {
+		t.Fatalf("Unexpected body %q", m.body)
+	}
+
+	m = msgs[1]
+	if m.subject != "" || m.body != " Starts folded\r\nSubject: Hi\r\n\r\nHello" {
+		t.Fatalf("Expected a message without headers, got %q: %q", m.atmHeaders, m.body)
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	for _, from := range []string{
+		"alice",
+		"alice@",
+		"@example.com",
+		"<alice@exa mple.com>",
+		"Alice <alice@example.com>",
+		"<alice@example.com>>",
+		"<alice@@example.com>",
+		"<alice@example.com",
+		"alice@example.com>",
+	} {
+		tc.cmd("MAIL FROM:"+from, 501)
+	}
+
+	for _, from := range []string{
+		"<alice@example.com>",
+		"alice@example.com",
+		`<"alice.smith"@example.com>`,
+		"<alice+tag@[192.0.2.1]>",
+		"<a.b-c_d@sub.example.com> BODY=8BITMIME",
+	} {
+		tc.cmd("MAIL FROM:"+from, 250)
+		tc.cmd("RSET", 250)
+	}
+
+	// The null reverse-path, for bounces
+	tc.cmd("MAIL FROM:<>", 250)
+	tc.cmd("RCPT TO:<>", 501)
+	tc.cmd("RCPT TO:<bob>", 501)
+	tc.cmd("RCPT TO:<bob@example.org> NOTIFY=NEVER", 250)
+	tc.cmd("RCPT TO:<Postmaster>", 250)
+	tc.sendMessage("Subject: Bounce\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message to be delivered, got %d", len(msgs))
+	}
+	if m := msgs[0]; m.envelopeFrom != "" || strings.Join(m.envelopeTo, ",") != "bob@example.org,Postmaster" {
+		t.Fatalf("Unexpected envelope from %q to %q", m.envelopeFrom, m.envelopeTo)
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{
+		Handler:       h,
+		MaxRecipients: 3,
+		AliasResolver: MemoryAliases{"team@example.org": {"carol@example.org", "dave@example.org"}},
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<r1@example.org>", 250)
+	tc.cmd("RCPT TO:<r2@example.org>", 250)
+	// An alias counts every address it expands to
+	tc.cmd("RCPT TO:<team@example.org>", 452)
+	tc.cmd("RCPT TO:<r3@example.org>", 250)
+	tc.cmd("RCPT TO:<r4@example.org>", 452)
+	tc.cmd("RCPT TO:<r5@example.org>", 452)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+
+	// The limit is per message
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<r1@example.org>", 250)
+	tc.cmd("RCPT TO:<team@example.org>", 250)
+	tc.cmd("RCPT TO:<r2@example.org>", 452)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if to := strings.Join(msgs[0].envelopeTo, ","); to != "r1@example.org,r2@example.org,r3@example.org" {
+		t.Fatalf("Unexpected recipients %s", to)
+	}
+	if to := strings.Join(msgs[1].envelopeTo, ","); to != "r1@example.org,carol@example.org,dave@example.org" {
+		t.Fatalf("Unexpected recipients %s", to)
+	}
+}
+
+func TestBDAT(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h, MaxMessageSize: 100}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	// The chunk is read even when the command is refused, the session
+	// stays in step
+	tc.sendRaw("BDAT 5 LAST\r\nHello")
+	tc.expect(503)
+	tc.cmd("BDAT x", 501)
+	tc.cmd("BDAT -1", 501)
+	tc.sendRaw("BDAT 1 FIRST\r\nx")
+	tc.expect(501)
+	tc.sendRaw("BDAT 2 LAST now\r\nxx")
+	tc.expect(501)
+
+	// Chunks are taken as they are, periods and all
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendRaw("BDAT 13\r\nSubject: Hi\r\n")
+	tc.expect(250)
+	tc.cmd("DATA", 503)
+	tc.sendRaw("BDAT 12\r\n\r\n.\r\nHello\r\n")
+	tc.expect(250)
+	tc.sendRaw("BDAT 0 last\r\n")
+	tc.expect(250)
+
+	// An empty message
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.cmd("BDAT 0 LAST", 250)
+
+	// Going over the limit throws the message away, the chunk is
+	// still read
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendRaw("BDAT 60\r\n" + strings.Repeat("x", 60))
+	tc.expect(250)
+	tc.sendRaw("BDAT 41 LAST\r\n" + strings.Repeat("x", 41))
+	tc.expect(552)
+	tc.sendRaw("BDAT 1 LAST\r\nx")
+	tc.expect(503)
+
+	// RSET throws away the chunks received so far
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendRaw("BDAT 60\r\n" + strings.Repeat("x", 60))
+	tc.expect(250)
+	tc.cmd("RSET", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendRaw("BDAT 60 LAST\r\nSubject: Again\r\n\r\n" + strings.Repeat("y", 60-len("Subject: Again\r\n\r\n")))
+	tc.expect(250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(msgs))
+	}
+	if m := msgs[0]; m.subject != "Hi" || m.body != ".\r\nHello" {
+		t.Fatalf("Unexpected message %q: %q", m.subject, m.body)
+	}
+	if m := msgs[1]; m.subject != "" || m.body != "" {
+		t.Fatalf("Expected an empty message, got %q: %q", m.subject, m.body)
+	}
+	if m := msgs[2]; m.subject != "Again" || m.body != strings.Repeat("y", 60-len("Subject: Again\r\n\r\n")) {
+		t.Fatalf("Unexpected message %q: %q", m.subject, m.body)
+	}
+}
+
+func TestBDATHugeChunk(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+
+	// Far more than could ever be accepted, the session ends rather
+	// than skipping it
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.cmd("BDAT 999999999999999 LAST", 552)
+	tc.expectClosed()
+
+	tc = connect(t, addr)
+	tc.startMail()
+	tc.cmd("BDAT 99999999999999999999999 LAST", 501)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+}
+
+func TestDotStuffing(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.cmd("DATA", 354)
+	tc.send("Subject: Dots", "", "..", "..data", "...", "not.stuffed", ". leading", ".")
+	tc.expect(250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+	if body := msgs[0].body; body != ".\r\n.data\r\n..\r\nnot.stuffed\r\n leading" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+}
+
+func TestDataEdgeCases(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	// A body filling the reader's buffer, with the closing period
+	// split across reads after it
+	long := strings.Repeat("x", 4096-len("Subject: Long\r\n\r\n")-len("\r\n")-1) + "\r\n"
+	tests := []struct {
+		name    string
+		chunks  []string
+		subject string
+		body    string
+	}{
+		{"empty", []string{".\r\n"}, "", ""},
+		{"header only", []string{"Subject: Hi\r\n.\r\n"}, "Hi", ""},
+		{"empty body", []string{"Subject: Hi\r\n\r\n.\r\n"}, "Hi", ""},
+		{"one line", []string{"Subject: Hi\r\n\r\nHello\r\n.\r\n"}, "Hi", "Hello"},
+		{"only a blank line", []string{"\r\n.\r\n"}, "", ""},
+		{"terminator split", []string{"Subject: Hi\r\n\r\nHello\r\n.", "\r\n"}, "Hi", "Hello"},
+		{"at buffer boundary", []string{"Subject: Long\r\n\r\n" + long + ".", "\r\n"}, "Long", strings.TrimSuffix(long, "\r\n")},
+	}
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	for _, test := range tests {
+		tc.cmd("MAIL FROM:<alice@example.com>", 250)
+		tc.cmd("RCPT TO:<bob@example.org>", 250)
+		tc.cmd("DATA", 354)
+		for _, chunk := range test.chunks {
+			tc.sendRaw(chunk)
+			// Give the server a chance to read each one on its own
+			time.Sleep(10 * time.Millisecond)
+		}
+		tc.expect(250)
+	}
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != len(tests) {
+		t.Fatalf("Expected %d messages, got %d", len(tests), len(msgs))
+	}
+	for i, test := range tests {
+		if m := msgs[i]; m.subject != test.subject || m.body != test.body {
+			t.Errorf("%s: expected %q: %q, got %q: %q", test.name, test.subject, test.body, m.subject, m.body)
+		}
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{
+		Handler:      h,
+		LocalDomains: []string{"example.org", "bücher.example", "xn--bcher-kva.example"},
+	}
+	addr := startServer(t, s)
+
+	tc, extensions := ehlo(t, addr)
+	if !containsLine(extensions, "SMTPUTF8") {
+		t.Fatalf("Expected SMTPUTF8 to be advertised, got %q", extensions)
+	}
+
+	// Without SMTPUTF8 only ASCII addresses are allowed, punycode
+	// domains included
+	tc.cmd("MAIL FROM:<jörg@bücher.example>", 553)
+	tc.cmd("MAIL FROM:<joerg@xn--bcher-kva.example>", 250)
+	tc.cmd("RCPT TO:<müller@example.org>", 553)
+	tc.cmd("RCPT TO:<info@bücher.example>", 553)
+	tc.cmd("RCPT TO:<info@xn--bcher-kva.example>", 250)
+	tc.sendMessage("Subject: ASCII\r\n\r\nHello\r\n", 250)
+
+	tc.cmd("MAIL FROM:<jörg@bücher.example> SMTPUTF8=yes", 501)
+	tc.cmd("MAIL FROM:<jörg@bücher.example> SMTPUTF8", 250)
+	tc.cmd("RCPT TO:<müller@example.org>", 250)
+	tc.cmd("RCPT TO:<用户@bücher.example>", 250)
+	tc.sendMessage("Subject: Grüße\r\nTo: Müller <müller@example.org>\r\n\r\nHallo\r\n", 250)
+	tc.cmd("QUIT", 221)
+
+	// SMTPUTF8 is an ESMTP extension
+	tc = connect(t, addr)
+	tc.cmd("HELO client.example.com", 250)
+	tc.cmd("MAIL FROM:<jörg@bücher.example> SMTPUTF8", 501)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	m := msgs[1]
+	if !m.smtputf8 || m.envelopeFrom != "jörg@bücher.example" || strings.Join(m.envelopeTo, ",") != "müller@example.org,用户@bücher.example" {
+		t.Fatalf("Unexpected envelope from %q to %q", m.envelopeFrom, m.envelopeTo)
+	}
+	if m.subject != "Grüße" || m.to != "Müller <müller@example.org>" {
+		t.Fatalf("Unexpected headers %q", m.atmHeaders)
+	}
+	if received := m.header("Received"); !strings.Contains(received, "with UTF8SMTP") {
+		t.Fatalf("Expected the Received header to name UTF8SMTP, got %q", received)
+	}
+	if msgs[0].smtputf8 || !strings.Contains(msgs[0].header("Received"), "with ESMTP") {
+		t.Fatalf("Expected the first message not to use SMTPUTF8, got %q", msgs[0].header("Received"))
+	}
+}
+
+func TestDataWithoutRecipients(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("DATA", 503)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.cmd("DATA", 503)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("DATA", 554)
+	// Refused recipients don't count
+	tc.cmd("RCPT TO:<bob@elsewhere.example>", 550)
+	tc.cmd("DATA", 554)
+	tc.sendRaw("BDAT 5 LAST\r\nHello")
+	tc.expect(503)
+
+	// The transaction can still go on
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("DATA", 503)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	if msgs := h.messages(); len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	headers := func(n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			b.WriteString("X-Header: " + strconv.Itoa(i) + "\r\n")
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		name string
+		s    *Server
+		data string
+		ok   bool
+	}{
+		{"count at the limit", &Server{MaxHeaders: 5}, headers(5) + "\r\nHello\r\n", true},
+		{"count over the limit", &Server{MaxHeaders: 5}, headers(6) + "\r\nHello\r\n", false},
+		// Folded lines are part of their field
+		{"folded count", &Server{MaxHeaders: 1}, "Subject: a\r\n b\r\n c\r\n\r\nHello\r\n", true},
+		{"size at the limit", &Server{MaxHeaderSize: 65}, headers(5) + "\r\nHello\r\n", true},
+		{"size over the limit", &Server{MaxHeaderSize: 64}, headers(5) + "\r\nHello\r\n", false},
+		{"one long field", &Server{MaxHeaderSize: 500}, "Subject: " + strings.Repeat("x", 800) + "\r\n\r\nHello\r\n", false},
+		{"long folded field", &Server{MaxHeaderSize: 500}, "Subject: x" + strings.Repeat("\r\n x", 250) + "\r\n\r\nHello\r\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &collectHandler{}
+			test.s.Handler = h
+			addr := startServer(t, test.s)
+
+			code := 552
+			if test.ok {
+				code = 250
+			}
+
+			tc := connect(t, addr)
+			tc.startMail()
+			tc.sendMessage(test.data, code)
+			if test.ok {
+				tc.cmd("QUIT", 221)
+			}
+			tc.expectClosed()
+
+			tc = connect(t, addr)
+			tc.startMail()
+			tc.sendRaw("BDAT " + strconv.Itoa(len(test.data)) + " LAST\r\n" + test.data)
+			tc.expect(code)
+			if test.ok {
+				tc.cmd("QUIT", 221)
+			}
+			tc.expectClosed()
+			waitIdle(t, test.s)
+
+			delivered := 0
+			if test.ok {
+				delivered = 2
+			}
+			if msgs := h.messages(); len(msgs) != delivered {
+				t.Fatalf("Expected %d messages, got %d", delivered, len(msgs))
+			}
+		})
+	}
+}
+
+func TestReceivedHeaderNamesTLS(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	config := &tls.Config{Certificates: []tls.Certificate{*cert}}
+	h := &collectHandler{}
+	s := &Server{Handler: h, TLSConfig: config, ImplicitTLSConfig: config}
+	addr := startServer(t, s)
+	implicitAddr := startServing(t, s, s.ServeTLS)
+
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.sendMessage("Subject: Plain\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+
+	tc = connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	tc.startTLS(&tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	tc.startMail()
+	tc.sendMessage("Subject: STARTTLS\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+
+	tc, state := dialTLS(t, implicitAddr, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	tc.startMail()
+	tc.sendMessage("Subject: Implicit\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(msgs))
+	}
+
+	want := []string{
+		" with ESMTP id ",
+		" with ESMTPS (TLSv1.2 TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) id ",
+		" with ESMTPS (TLSv1.3 " + tls.CipherSuiteName(state.CipherSuite) + ") id ",
+	}
+	for i, m := range msgs {
+		if received := m.header("Received"); !strings.Contains(received, want[i]) {
+			t.Errorf("%s: expected the Received header to contain %q, got %q", m.subject, want[i], received)
+		}
+	}
+}
+
+func TestDataAndBDATAgree(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	bodies := []string{
+		"",
+		"Hello",
+		".",
+		"..",
+		"Hello\r\n.\r\nWorld",
+		".Hello\r\n..World\r\n",
+		"Bare\nLF\n.\nlines",
+		"Bare\rCR\r.",
+		"\r\n\r\n",
+	}
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	for _, body := range bodies {
+		content := "Subject: Hi\r\n\r\n" + body + "\r\n"
+		tc.cmd("MAIL FROM:<alice@example.com>", 250)
+		tc.cmd("RCPT TO:<bob@example.org>", 250)
+		tc.cmd("DATA", 354)
+		tc.sendRaw(dotStuff(strings.TrimSuffix(content, "\r\n")))
+		tc.expect(250)
+
+		tc.cmd("MAIL FROM:<alice@example.com>", 250)
+		tc.cmd("RCPT TO:<bob@example.org>", 250)
+		tc.sendRaw("BDAT " + strconv.Itoa(len(content)) + " LAST\r\n" + content)
+		tc.expect(250)
+	}
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 2*len(bodies) {
+		t.Fatalf("Expected %d messages, got %d", 2*len(bodies), len(msgs))
+	}
+	for i, body := range bodies {
+		data, bdat := msgs[2*i], msgs[2*i+1]
+		if data.body != body || bdat.body != body {
+			t.Errorf("Expected %q, got %q with DATA and %q with BDAT", body, data.body, bdat.body)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	received := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date string
+		// want is in UTC, zero if the date can't be parsed
+		want string
+	}{
+		{"Fri, 21 Nov 1997 09:55:06 -0600", "1997-11-21T15:55:06Z"},
+		{"21 Nov 1997 09:55:06 -0600", "1997-11-21T15:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55 -0600", "1997-11-21T15:55:00Z"},
+		{"Thu, 13 Feb 1969 23:32:54 -0330", "1969-02-14T03:02:54Z"},
+		{"Fri, 21 Nov 1997 09:55:06 -0600 (MDT)", "1997-11-21T15:55:06Z"},
+		{"Fri,  21 Nov 1997  09:55:06   -0600", "1997-11-21T15:55:06Z"},
+		{"Tue, 1 Jul 2003 10:52:37 +0200", "2003-07-01T08:52:37Z"},
+		// Obsolete zone names, RFC 5322 section 4.3
+		{"Mon, 1 Jan 2001 00:00:00 UT", "2001-01-01T00:00:00Z"},
+		{"Mon, 1 Jan 2001 00:00:00 GMT", "2001-01-01T00:00:00Z"},
+		{"Fri, 21 Nov 1997 09:55:06 EST", "1997-11-21T14:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 EDT", "1997-11-21T13:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 CST", "1997-11-21T15:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 CDT", "1997-11-21T14:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 MST", "1997-11-21T16:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 MDT", "1997-11-21T15:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 PST", "1997-11-21T17:55:06Z"},
+		{"Fri, 21 Nov 1997 09:55:06 PDT", "1997-11-21T16:55:06Z"},
+		// Obsolete two digit years
+		{"Fri, 21 Nov 97 09:55:06 GMT", "1997-11-21T09:55:06Z"},
+		{"", ""},
+		{"yesterday", ""},
+		{"Fri, 32 Nov 1997 09:55:06 -0600", ""},
+	}
+
+	for _, test := range tests {
+		m := &message{date: test.date, received: received}
+		m.parseDate()
+
+		if test.want == "" {
+			if !m.dateSynthesized || !m.dateTime.Equal(received) {
+				t.Errorf("%q: expected the time received, got %s", test.date, m.dateTime)
+			}
+			continue
+		}
+
+		if m.dateSynthesized {
+			t.Errorf("%q: couldn't be parsed", test.date)
+			continue
+		}
+		if got := m.dateTime.UTC().Format(time.RFC3339); got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.date, test.want, got)
+		}
+	}
+}
+
+func TestParseDateLocalZone(t *testing.T) {
+	// A zone name that is also the local zone's is parsed with its
+	// offset already
+	local, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone database")
+	}
+
+	saved := time.Local
+	time.Local = local
+	defer func() { time.Local = saved }()
+
+	for date, want := range map[string]string{
+		"Fri, 21 Nov 1997 09:55:06 EST": "1997-11-21T14:55:06Z",
+		"Tue, 1 Jul 2003 10:52:37 EDT":  "2003-07-01T14:52:37Z",
+		"Tue, 1 Jul 2003 10:52:37 PDT":  "2003-07-01T17:52:37Z",
+	} {
+		m := &message{date: date}
+		m.parseDate()
+		if got := m.dateTime.UTC().Format(time.RFC3339); got != want {
+			t.Errorf("%q: expected %s, got %s", date, want, got)
+		}
+	}
+}
+
+func TestDateHeaderSession(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	before := time.Now()
+	tc := connect(t, addr)
+	tc.startMail()
+	tc.sendMessage("Date: Fri, 21 Nov 1997 09:55:06 PST\r\nSubject: Dated\r\n\r\nHello\r\n", 250)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendMessage("Date: someday\r\nSubject: Undated\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+
+	want := time.Date(1997, 11, 21, 17, 55, 6, 0, time.UTC)
+	if msgs[0].dateSynthesized || !msgs[0].dateTime.Equal(want) {
+		t.Errorf("Expected %s, got %s", want, msgs[0].dateTime)
+	}
+	if _, offset := msgs[0].dateTime.Zone(); offset != -8*3600 {
+		t.Errorf("Expected offset -0800, got %d", offset)
+	}
+
+	if !msgs[1].dateSynthesized || !msgs[1].dateTime.Equal(msgs[1].received) || msgs[1].dateTime.Before(before.Truncate(time.Second)) {
+		t.Errorf("Expected the time received, got %s", msgs[1].dateTime)
+	}
+	if msgs[1].date != "someday" {
+		t.Errorf("Expected the Date header kept, got %q", msgs[1].date)
+	}
+}
+
+func TestBareCR(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{
+		Handler:          h,
+		XClientAllowList: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		OnHeader: func(name, value string) (string, bool) {
+			if name == "X-Rewrite" {
+				return "one\r\nBcc: carol@example.com\n", false
+			}
+			return value, false
+		},
+	}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client\r.example.com", 501)
+	tc.cmd("EHLO client.example.com", 250)
+	if lines := tc.cmd("NOOP\r", 501); lines[0] != "5.5.2 Syntax error, bare CR in command" {
+		t.Fatalf("Unexpected reply %q", lines)
+	}
+	tc.cmd("MAIL FROM:<alice@example.com>\rRCPT TO:<carol@example.org>", 501)
+	tc.cmd("MAIL FROM:<alice@example.com> ENVID=a+0D+0AInjected:+20yes", 501)
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org> ORCPT=rfc822;bob+0A@example.org", 501)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+
+	// In a header line, or in a continuation line
+	for _, data := range []string{
+		"Subject: Hi\rBcc: carol@example.com\r\n\r\nHello\r\n",
+		"Subject: Hi\r\n there\r\r\n\r\nHello\r\n",
+	} {
+		tc.sendMessage(data, 550)
+		tc.cmd("MAIL FROM:<alice@example.com>", 250)
+		tc.cmd("RCPT TO:<bob@example.org>", 250)
+	}
+
+	// BDAT shares the header parser
+	data := "Subject: Hi\rBcc: carol@example.com\r\n\r\nHello\r\n"
+	tc.sendRaw("BDAT " + strconv.Itoa(len(data)) + " LAST\r\n" + data)
+	if lines := tc.expect(550); lines[0] != "5.6.0 Malformed header" {
+		t.Fatalf("Unexpected reply %q", lines)
+	}
+
+	// Bare CRs in the body are left alone, line breaks are taken out of
+	// rewritten headers
+	tc.cmd("MAIL FROM:<alice@example.com>", 250)
+	tc.cmd("RCPT TO:<bob@example.org>", 250)
+	tc.sendMessage("Subject: Hi\r\nX-Rewrite: original\r\n\r\nHello\rthere\r\n", 250)
+
+	tc.cmd("XCLIENT NAME=client+0D+0A.example.com", 501)
+	tc.cmd("XCLIENT HELO=client+0A.example.com", 501)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	msgs := h.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if m.body != "Hello\rthere" {
+		t.Errorf("Expected the bare CR kept in the body, got %q", m.body)
+	}
+	if m.header("X-Rewrite") != "oneBcc: carol@example.com" || m.header("Bcc") != "" {
+		t.Errorf("Expected the rewritten header on one line, got %q", m.header("X-Rewrite"))
+	}
+	for _, h := range m.atmHeaders {
+		if h.name == "X-Rewrite" && h.raw != "X-Rewrite: oneBcc: carol@example.com" {
+			t.Errorf("Expected the rewritten header on one line, got %q", h.raw)
+		}
+	}
+}
+
+func TestObsoleteCommands(t *testing.T) {
+	h := &collectHandler{}
+	s := &Server{Handler: h}
+	addr := startServer(t, s)
+
+	verbs := []string{"SEND", "SOML", "SAML", "TURN", "send", "Turn"}
+	tc := connect(t, addr)
+	for _, verb := range verbs {
+		tc.cmd(verb+" FROM:<alice@example.com>", 502)
+	}
+	tc.cmd("EHLO client.example.com", 250)
+	for _, verb := range verbs {
+		if lines := tc.cmd(verb, 502); lines[0] != "5.5.1 Command not implemented" {
+			t.Fatalf("%s: unexpected reply %q", verb, lines)
+		}
+	}
+
+	// The transaction goes on
+	tc.startMail()
+	for _, verb := range verbs {
+		tc.cmd(verb+" FROM:<alice@example.com>", 502)
+	}
+	tc.sendMessage("Subject: Hi\r\n\r\nHello\r\n", 250)
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+
+	if msgs := h.messages(); len(msgs) != 1 || strings.Join(msgs[0].envelopeTo, ",") != "bob@example.org" {
+		t.Fatalf("Expected 1 message to bob@example.org, got %d", len(msgs))
+	}
+}
+
+func TestMultilineEnhancedCodes(t *testing.T) {
+	s := &Server{Handler: &collectHandler{}}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("HELO client.example.com", 250)
+	for _, line := range tc.cmd("HELP", 214) {
+		if strings.HasPrefix(line, "2.0.0") {
+			t.Fatalf("Expected no enhanced code without EHLO, got %q", line)
+		}
+	}
+
+	// Every line gets one, except in the EHLO reply itself
+	for _, line := range tc.cmd("EHLO client.example.com", 250) {
+		if strings.HasPrefix(line, "2.0.0") {
+			t.Fatalf("Expected no enhanced code in the EHLO reply, got %q", line)
+		}
+	}
+	for _, line := range tc.cmd("HELP", 214) {
+		if !strings.HasPrefix(line, "2.0.0 ") {
+			t.Fatalf("Expected an enhanced code on every line, got %q", line)
+		}
+	}
+	tc.cmd("QUIT", 221)
+}
+
+// directory answers VRFY and EXPN from a fixed map of names.
+type directory map[string][]string
+
+func (d directory) Verify(query string) (VerifyResult, string, error) {
+	addresses, ok := d[query]
+	if !ok {
+		return VerifyNotFound, "", nil
+	}
+
+	return VerifyFound, addresses[0], nil
+}
+
+func (d directory) Expand(list string) ([]string, bool, error) {
+	members, ok := d[list]
+	return members, ok, nil
+}
+
+func TestVerifyLineBreaks(t *testing.T) {
+	d := directory{
+		"bob":    {"Bob <bob@example.org>"},
+		"mallet": {"<mallet@example.org>\r\n250 OK"},
+		"staff":  {"Bob <bob@example.org>", "Carol <carol@example.org>"},
+		"spoof":  {"Bob <bob@example.org>", "<mallet@example.org>\n250 OK"},
+	}
+	s := &Server{Handler: &collectHandler{}, RecipientVerifier: d, ListExpander: d}
+	addr := startServer(t, s)
+
+	tc := connect(t, addr)
+	tc.cmd("EHLO client.example.com", 250)
+	if lines := tc.cmd("VRFY bob", 250); lines[0] != "2.1.5 Bob <bob@example.org>" {
+		t.Fatalf("Unexpected VRFY reply %q", lines)
+	}
+	if lines := tc.cmd("EXPN staff", 250); len(lines) != 2 || lines[1] != "2.1.5 Carol <carol@example.org>" {
+		t.Fatalf("Unexpected EXPN reply %q", lines)
+	}
+
+	// A line break can't end the reply early and leave the rest to be
+	// read as another one
+	tc.cmd("VRFY mallet", 451)
+	tc.cmd("EXPN spoof", 451)
+	tc.cmd("NOOP", 250)
+	tc.cmd("QUIT", 221)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 7208 section 4.6.4 asks for at least 20 seconds for the whole
+// check
+const defaultDNSTimeout = 20 * time.Second
+
+// spfMaxLookups limits the terms that cause DNS lookups, RFC 7208
+// section 4.6.4.
+const spfMaxLookups = 10
+
+// spfResult is the outcome of an SPF check, RFC 7208 section 2.6.
+type spfResult string
+
+const (
+	spfNone      spfResult = "none"
+	spfNeutral   spfResult = "neutral"
+	spfPass      spfResult = "pass"
+	spfFail      spfResult = "fail"
+	spfSoftFail  spfResult = "softfail"
+	spfTempError spfResult = "temperror"
+	spfPermError spfResult = "permerror"
+)
+
+var (
+	errSPFTemp = errors.New("Temporary DNS failure")
+	errSPFPerm = errors.New("Invalid SPF record")
+)
+
+// spfCheck carries the state of one check_host() evaluation, which
+// may recurse into other domains through include and redirect.
+type spfCheck struct {
+	resolver *net.Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+func (s *Server) resolver() *net.Resolver {
+	if s.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return s.Resolver
+}
+
+// checkSPF checks whether the client may send mail from sender, an
+// empty sender standing for a bounce from the HELO domain.
+func (c *connection) checkSPF(sender string) spfResult {
+	ip := net.ParseIP(remoteIP(c.clientAddr()))
+	if ip == nil {
+		return spfNone
+	}
+
+	helo := c.msg.clientDomain
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+
+	domain := sender[strings.LastIndexByte(sender, '@')+1:]
+	if domain == "" {
+		return spfNone
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, defaultDNSTimeout)
+	defer cancel()
+
+	check := spfCheck{resolver: c.server.resolver(), ip: ip, sender: sender, helo: helo}
+	return check.checkHost(ctx, domain)
+}
+
+// checkHost is check_host() from RFC 7208 section 4.
+func (sc *spfCheck) checkHost(ctx context.Context, domain string) spfResult {
+	record, result := sc.lookupRecord(ctx, domain)
+	if record == "" {
+		return result
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers are name=value, mechanisms never have an equals
+		// sign before their argument starts
+		if i := strings.IndexAny(term, "=:/"); i > 0 && term[i] == '=' {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+
+			// exp and unknown modifiers don't affect the result
+			continue
+		}
+
+		result := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = spfFail, term[1:]
+		case '~':
+			result, term = spfSoftFail, term[1:]
+		case '?':
+			result, term = spfNeutral, term[1:]
+		}
+
+		match, err := sc.match(ctx, domain, term)
+		if err == errSPFTemp {
+			return spfTempError
+		}
+		if err != nil {
+			return spfPermError
+		}
+
+		if match {
+			return result
+		}
+	}
+
+	if redirect == "" {
+		return spfNeutral
+	}
+
+	target, err := sc.expand(redirect, domain)
+	if err != nil || !sc.countLookup() {
+		return spfPermError
+	}
+
+	result = sc.checkHost(ctx, target)
+	if result == spfNone {
+		return spfPermError
+	}
+
+	return result
+}
+
+// lookupRecord finds the SPF record of domain. It returns an empty
+// record and the result to give if there isn't exactly one.
+func (sc *spfCheck) lookupRecord(ctx context.Context, domain string) (string, spfResult) {
+	txts, err := sc.resolver.LookupTXT(ctx, domain)
+	if isNotFound(err) {
+		return "", spfNone
+	}
+	if err != nil {
+		return "", spfTempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || hasPrefixFold(txt, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", spfNone
+	case 1:
+		return records[0], ""
+	}
+
+	return "", spfPermError
+}
+
+// countLookup counts a term that needs DNS, returning false once there
+// have been too many.
+func (sc *spfCheck) countLookup() bool {
+	sc.lookups++
+	return sc.lookups <= spfMaxLookups
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// match evaluates one mechanism, without its qualifier.
+func (sc *spfCheck) match(ctx context.Context, domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, errSPFPerm
+		}
+
+		return true, nil
+	case "ip4", "ip6":
+		return sc.matchIP(name, strings.TrimPrefix(arg, ":"))
+	}
+
+	if !sc.countLookup() {
+		return false, errSPFPerm
+	}
+
+	target, v4, v6, err := parseDualCIDR(arg)
+	if err != nil {
+		return false, err
+	}
+
+	if target == "" {
+		target = domain
+	} else {
+		target, err = sc.expand(target, domain)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch name {
+	case "include":
+		if arg == "" {
+			return false, errSPFPerm
+		}
+
+		switch sc.checkHost(ctx, target) {
+		case spfPass:
+			return true, nil
+		case spfTempError:
+			return false, errSPFTemp
+		case spfPermError, spfNone:
+			return false, errSPFPerm
+		}
+
+		return false, nil
+	case "a":
+		return sc.matchHost(ctx, target, v4, v6)
+	case "mx":
+		mxs, err := sc.resolver.LookupMX(ctx, target)
+		if isNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errSPFTemp
+		}
+
+		// RFC 7208 section 4.6.4
+		if len(mxs) > 10 {
+			return false, errSPFPerm
+		}
+
+		for _, mx := range mxs {
+			match, err := sc.matchHost(ctx, mx.Host, v4, v6)
+			if match || err != nil {
+				return match, err
+			}
+		}
+
+		return false, nil
+	case "exists":
+		if arg == "" {
+			return false, errSPFPerm
+		}
+
+		ips, err := sc.resolver.LookupIP(ctx, "ip4", target)
+		if isNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errSPFTemp
+		}
+
+		return len(ips) > 0, nil
+	case "ptr":
+		return sc.matchPTR(ctx, target)
+	}
+
+	return false, errSPFPerm
+}
+
+// matchHost reports whether the client is within the given prefix
+// lengths of an address of host.
+func (sc *spfCheck) matchHost(ctx context.Context, host string, v4, v6 int) (bool, error) {
+	addrs, err := sc.resolver.LookupIPAddr(ctx, host)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errSPFTemp
+	}
+
+	for _, addr := range addrs {
+		if cidrContains(addr.IP, sc.ip, v4, v6) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (sc *spfCheck) matchIP(name, arg string) (bool, error) {
+	prefix := -1
+	if i := strings.IndexByte(arg, '/'); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil {
+			return false, errSPFPerm
+		}
+
+		prefix, arg = n, arg[:i]
+	}
+
+	ip := net.ParseIP(arg)
+	if ip == nil || (name == "ip4") != (ip.To4() != nil) {
+		return false, errSPFPerm
+	}
+
+	if prefix < 0 {
+		prefix = 128
+		if name == "ip4" {
+			prefix = 32
+		}
+	}
+
+	return cidrContains(ip, sc.ip, prefix, prefix), nil
+}
+
+// matchPTR implements the deprecated ptr mechanism: some validated
+// name of the client must be in target.
+func (sc *spfCheck) matchPTR(ctx context.Context, target string) (bool, error) {
+	names, err := sc.resolver.LookupAddr(ctx, sc.ip.String())
+	if err != nil {
+		// Errors are treated as no match, RFC 7208 section 5.5
+		return false, nil
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for i, name := range names {
+		// Only the first few names are looked into
+		if i == 10 {
+			break
+		}
+
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+
+		match, _ := sc.matchHost(ctx, name, 32, 128)
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// cidrContains reports whether ip is within the network of network's
+// address and the prefix length matching its family.
+func cidrContains(network, ip net.IP, v4, v6 int) bool {
+	if network4, ip4 := network.To4(), ip.To4(); network4 != nil || ip4 != nil {
+		if network4 == nil || ip4 == nil || v4 > 32 {
+			return false
+		}
+
+		mask := net.CIDRMask(v4, 32)
+		return network4.Mask(mask).Equal(ip4.Mask(mask))
+	}
+
+	if v6 > 128 {
+		return false
+	}
+
+	mask := net.CIDRMask(v6, 128)
+	return network.Mask(mask).Equal(ip.Mask(mask))
+}
+
+// parseDualCIDR splits a mechanism argument like ":example.com/24//64"
+// into the domain and the IPv4 and IPv6 prefix lengths, which default
+// to a single address.
+func parseDualCIDR(arg string) (string, int, int, error) {
+	arg = strings.TrimPrefix(arg, ":")
+	v4, v6 := 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+
+		v6, arg = n, arg[:i]
+	}
+
+	if i := strings.LastIndexByte(arg, '/'); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+
+		v4, arg = n, arg[:i]
+	}
+
+	return arg, v4, v6, nil
+}
+
+// expand expands the macros in a domain-spec, RFC 7208 section 7.
+func (sc *spfCheck) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+		if i == len(spec) {
+			return "", errSPFPerm
+		}
+
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "", errSPFPerm
+		}
+
+		value, err := sc.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(value)
+		i += end
+	}
+
+	return b.String(), nil
+}
+
+// macro expands the inside of one %{...}: a letter, then optionally
+// how many parts to keep, whether to reverse them and what they are
+// split on.
+func (sc *spfCheck) macro(m, domain string) (string, error) {
+	if m == "" {
+		return "", errSPFPerm
+	}
+
+	local := sc.sender
+	if at := strings.LastIndexByte(sc.sender, '@'); at >= 0 {
+		local = sc.sender[:at]
+	}
+
+	var value string
+	switch strings.ToLower(m[:1]) {
+	case "s":
+		value = sc.sender
+	case "l":
+		value = local
+	case "o":
+		value = strings.TrimPrefix(sc.sender[len(local):], "@")
+	case "d":
+		value = domain
+	case "i":
+		value = spfIPMacro(sc.ip)
+	case "v":
+		value = "ip6"
+		if sc.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case "h":
+		value = sc.helo
+	default:
+		return "", errSPFPerm
+	}
+
+	m = m[1:]
+	digits := 0
+	for digits < len(m) && m[digits] >= '0' && m[digits] <= '9' {
+		digits++
+	}
+
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(m[:digits])
+		if err != nil || n == 0 {
+			return "", errSPFPerm
+		}
+
+		keep = n
+	}
+	m = m[digits:]
+
+	reverse := strings.HasPrefix(m, "r") || strings.HasPrefix(m, "R")
+	if reverse {
+		m = m[1:]
+	}
+
+	delimiters := m
+	if delimiters == "" {
+		delimiters = "."
+	}
+	if strings.Trim(delimiters, ".-+,/_=") != "" {
+		return "", errSPFPerm
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+// spfIPMacro formats ip for %{i}: dotted quads for IPv4, dotted
+// nibbles for IPv6.
+func spfIPMacro(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	const hex = "0123456789abcdef"
+	var nibbles []string
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+
+	return strings.Join(nibbles, ".")
+}
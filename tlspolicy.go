@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// defaultTLSMinVersion is the oldest TLS version accepted unless
+// configured otherwise. Older ones have known weaknesses, RFC 8996.
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// prepareTLS applies the server's TLS policy to copies of TLSConfig and
+// ImplicitTLSConfig, which connections use from then on. It is only
+// done once, so the configurations stay the same for every connection
+// and session resumption keeps working. It fails on a policy that
+// can't be met.
+func (s *Server) prepareTLS() error {
+	s.tlsOnce.Do(func() {
+		s.startTLSConfig, s.tlsErr = s.applyTLSPolicy(s.TLSConfig)
+		if s.tlsErr == nil {
+			s.implicitTLSConfig, s.tlsErr = s.applyTLSPolicy(s.ImplicitTLSConfig)
+		}
+	})
+
+	return s.tlsErr
+}
+
+func (s *Server) applyTLSPolicy(config *tls.Config) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	config = config.Clone()
+	if s.TLSMinVersion != 0 {
+		config.MinVersion = s.TLSMinVersion
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = defaultTLSMinVersion
+	}
+	if s.TLSCipherSuites != nil {
+		config.CipherSuites = s.TLSCipherSuites
+	}
+	if len(s.TLSCertificates) > 0 {
+		config.GetCertificate = s.sniCertificate(config.GetCertificate)
+	}
+
+	if _, ok := tlsVersionNames[config.MinVersion]; !ok {
+		return nil, fmt.Errorf("Unknown TLS version 0x%04x", config.MinVersion)
+	}
+
+	if config.CipherSuites == nil {
+		return config, nil
+	}
+
+	// TLS 1.3 suites aren't configurable, RFC 8446 ones are always used
+	if config.MinVersion == tls.VersionTLS13 {
+		return nil, errors.New("Cipher suites can't be configured when TLS 1.3 is the minimum version")
+	}
+
+	usable := false
+	for _, id := range config.CipherSuites {
+		suite := lookupCipherSuite(id)
+		if suite == nil {
+			return nil, fmt.Errorf("Unknown or insecure TLS cipher suite 0x%04x", id)
+		}
+
+		for _, version := range suite.SupportedVersions {
+			if version >= config.MinVersion && version < tls.VersionTLS13 {
+				usable = true
+			}
+		}
+	}
+
+	if !usable {
+		return nil, errors.New("None of the TLS cipher suites can be used with TLS " + tlsVersionNames[config.MinVersion] + " or later")
+	}
+
+	return config, nil
+}
+
+// sniCertificate returns a tls.Config.GetCertificate picking from
+// TLSCertificates, and otherwise asking fallback if there is one.
+func (s *Server) sniCertificate(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := map[string]*tls.Certificate{}
+	for name, cert := range s.TLSCertificates {
+		certs[strings.ToLower(strings.TrimSuffix(name, "."))] = cert
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if cert, ok := certs[name]; ok && name != "" {
+			return cert, nil
+		}
+
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := certs["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+
+		if fallback != nil {
+			return fallback(hello)
+		}
+
+		// Leaves it to the configuration's Certificates
+		return nil, nil
+	}
+}
+
+func lookupCipherSuite(id uint16) *tls.CipherSuite {
+	for _, suite := range tls.CipherSuites() {
+		if suite.ID == id {
+			return suite
+		}
+	}
+
+	return nil
+}
+
+// parseTLSVersion reads a TLS version such as "1.2" or "TLSv1.2".
+func parseTLSVersion(s string) (uint16, error) {
+	name := "TLSv" + strings.TrimPrefix(s, "TLSv")
+	for version, n := range tlsVersionNames {
+		if n == name {
+			return version, nil
+		}
+	}
+
+	return 0, errors.New("Unknown TLS version: " + s)
+}
+
+// parseCipherSuites reads a comma separated list of cipher suite
+// names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Insecure suites
+// aren't accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, errors.New("Unknown or insecure TLS cipher suite: " + name)
+		}
+	}
+
+	return ids, nil
+}
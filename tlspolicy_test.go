@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestSNICertificate(t *testing.T) {
+	mail := testCertificate(t, "mail.example.org")
+	wildcard := testCertificate(t, "*.example.net")
+	exact := testCertificate(t, "smtp.example.net")
+	fallback := testCertificate(t, "fallback.example.com")
+	s := &Server{TLSCertificates: map[string]*tls.Certificate{
+		"Mail.Example.org.": mail,
+		"*.example.net":     wildcard,
+		"smtp.example.net":  exact,
+	}}
+
+	tests := []struct {
+		serverName string
+		cert       *tls.Certificate
+	}{
+		{"mail.example.org", mail},
+		{"MAIL.EXAMPLE.ORG", mail},
+		{"mail.example.org.", mail},
+		{"mx.example.net", wildcard},
+		{"smtp.example.net", exact},
+		// A wildcard only stands for one label
+		{"a.mx.example.net", fallback},
+		{"example.net", fallback},
+		{"other.example.org", fallback},
+		{"", fallback},
+	}
+
+	get := s.sniCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return fallback, nil
+	})
+	for _, test := range tests {
+		cert, err := get(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cert != test.cert {
+			t.Errorf("%q: expected the certificate for %s", test.serverName, test.cert.Leaf.Subject.CommonName)
+		}
+	}
+
+	// Without a fallback the configuration's Certificates are used
+	cert, err := s.sniCertificate(nil)(&tls.ClientHelloInfo{ServerName: "other.example.org"})
+	if cert != nil || err != nil {
+		t.Fatalf("Expected no certificate, got one and %v", err)
+	}
+
+	// The fallback's errors are the handshake's
+	failed := errors.New("No certificate")
+	_, err = s.sniCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, failed
+	})(&tls.ClientHelloInfo{ServerName: "other.example.org"})
+	if err != failed {
+		t.Fatalf("Expected the fallback's error, got %v", err)
+	}
+}
+
+func TestSNISession(t *testing.T) {
+	defaultCert := testCertificate(t, "example.org")
+	config := &tls.Config{Certificates: []tls.Certificate{*defaultCert}}
+	s := &Server{
+		TLSConfig:         config,
+		ImplicitTLSConfig: config,
+		TLSCertificates: map[string]*tls.Certificate{
+			"mail.example.org": testCertificate(t, "mail.example.org"),
+			"*.example.net":    testCertificate(t, "*.example.net"),
+		},
+	}
+	addr := startServer(t, s)
+	implicitAddr := startServing(t, s, s.ServeTLS)
+
+	tests := []struct {
+		serverName string
+		commonName string
+	}{
+		{"mail.example.org", "mail.example.org"},
+		{"mx.example.net", "*.example.net"},
+		{"other.example.com", "example.org"},
+		{"", "example.org"},
+	}
+
+	for _, test := range tests {
+		client := &tls.Config{ServerName: test.serverName, InsecureSkipVerify: true}
+
+		tc, state := dialTLS(t, implicitAddr, client)
+		if got := state.PeerCertificates[0].Subject.CommonName; got != test.commonName {
+			t.Errorf("Implicit TLS to %q: expected the certificate for %s, got %s", test.serverName, test.commonName, got)
+		}
+		tc.cmd("QUIT", 221)
+
+		tc = connect(t, addr)
+		tc.cmd("EHLO client.example.com", 250)
+		state = tc.startTLS(client)
+		if got := state.PeerCertificates[0].Subject.CommonName; got != test.commonName {
+			t.Errorf("STARTTLS to %q: expected the certificate for %s, got %s", test.serverName, test.commonName, got)
+		}
+		tc.cmd("QUIT", 221)
+	}
+
+	// The certificate verifies for the name it was picked for
+	roots := x509Pool(t, s.TLSCertificates["mail.example.org"])
+	tc, _ := dialTLS(t, implicitAddr, &tls.Config{ServerName: "mail.example.org", RootCAs: roots})
+	tc.cmd("QUIT", 221)
+	waitIdle(t, s)
+}
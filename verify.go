@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// VerifyResult is a RecipientVerifier's answer about one address.
+type VerifyResult int
+
+const (
+	// VerifyUnsure means the address can't be checked, but mail to it
+	// will still be attempted.
+	VerifyUnsure VerifyResult = iota
+	VerifyFound
+	VerifyNotFound
+)
+
+// RecipientVerifier answers VRFY queries. On VerifyFound it also
+// returns the full address the query resolved to.
+type RecipientVerifier interface {
+	Verify(query string) (VerifyResult, string, error)
+}
+
+func (c *connection) vrfy(query string) (int, string) {
+	if query == "" {
+		return 501, "5.5.4 Syntax error in parameters"
+	}
+
+	// Not revealing which users exist is the safe default
+	if c.server.RecipientVerifier == nil {
+		return 252, "Cannot VRFY user, but will accept message and attempt delivery"
+	}
+
+	result, address, err := c.server.RecipientVerifier.Verify(query)
+	if err != nil {
+		c.logError(err)
+		return 451, "4.3.0 Requested action aborted: local error in processing"
+	}
+
+	switch result {
+	case VerifyFound:
+		// A line break would let the address end the reply early
+		if strings.ContainsAny(address, "\r\n") {
+			c.logError(errors.New("RecipientVerifier returned an address with a line break"))
+			return 451, "4.3.0 Requested action aborted: local error in processing"
+		}
+
+		return 250, "2.1.5 " + address
+	case VerifyNotFound:
+		return 550, "5.1.1 No such user"
+	default:
+		return 252, "Cannot VRFY user, but will accept message and attempt delivery"
+	}
+}
+
+// ListExpander answers EXPN queries. It reports whether list is a
+// mailing list it knows and if so returns its members, each as a
+// mailbox such as "Jon Postel <postel@example.org>".
+type ListExpander interface {
+	Expand(list string) ([]string, bool, error)
+}
+
+func (c *connection) expn(list string) (int, []string) {
+	if c.server.ListExpander == nil {
+		return 502, []string{"5.5.1 Command not implemented"}
+	}
+
+	if list == "" {
+		return 501, []string{"5.5.4 Syntax error in parameters"}
+	}
+
+	members, ok, err := c.server.ListExpander.Expand(list)
+	if err != nil {
+		c.logError(err)
+		return 451, []string{"4.3.0 Requested action aborted: local error in processing"}
+	}
+
+	if !ok || len(members) == 0 {
+		return 550, []string{"5.1.1 No such mailing list"}
+	}
+
+	lines := make([]string, len(members))
+	for i, member := range members {
+		if strings.ContainsAny(member, "\r\n") {
+			c.logError(errors.New("ListExpander returned a member with a line break"))
+			return 451, []string{"4.3.0 Requested action aborted: local error in processing"}
+		}
+
+		lines[i] = "2.1.5 " + member
+	}
+
+	return 250, lines
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// xclientAttributes are the XCLIENT attributes understood, advertised
+// after the keyword.
+const xclientAttributes = "ADDR PORT NAME HELO LOGIN"
+
+// xclientAllowed reports whether the client is a trusted front-end,
+// see Server.XClientAllowList. It is checked against the address the
+// connection really comes from, not one passed on earlier.
+func (c *connection) xclientAllowed() bool {
+	return containsIP(c.server.XClientAllowList, net.ParseIP(remoteIP(c.conn.RemoteAddr())))
+}
+
+// xclient handles XCLIENT, with which a trusted front-end hands over
+// what it knows about the client it is proxying for, see
+// http://www.postfix.org/XCLIENT_README.html. Attributes that aren't
+// given keep their value. The session starts over as if the client had
+// just connected.
+func (c *connection) xclient(arg string) error {
+	if !c.xclientAllowed() {
+		c.logInfo("Refused XCLIENT from an untrusted client")
+		return c.reply(550, "5.7.0 Insufficient authorization")
+	}
+
+	if c.state != stateConnected && c.state != stateGreeted {
+		return c.badSequence()
+	}
+
+	attrs := map[string]string{}
+	for _, field := range strings.Fields(arg) {
+		pieces := strings.SplitN(field, "=", 2)
+		name := strings.ToUpper(pieces[0])
+		if len(pieces) != 2 || !strings.Contains(" "+xclientAttributes+" ", " "+name+" ") {
+			return c.reply(501, "5.5.4 Bad XCLIENT attribute: "+pieces[0])
+		}
+
+		value, err := decodeXtext(pieces[1])
+		if err != nil || strings.ContainsAny(value, "\r\n\x00") {
+			return c.reply(501, "5.5.4 Bad XCLIENT attribute value: "+pieces[0])
+		}
+
+		// The front-end doesn't know these either
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+		attrs[name] = value
+	}
+
+	if len(attrs) == 0 {
+		return c.reply(501, "5.5.4 Syntax error in parameters")
+	}
+
+	addr, ok := c.xclientAddress(attrs)
+	if !ok {
+		return c.reply(501, "5.5.4 Bad XCLIENT address")
+	}
+
+	if addr != nil {
+		c.xclientAddr = addr
+		// The hostname belonged to the front-end
+		c.remoteHost, c.remoteHostVerified = "", false
+		if _, ok := attrs["NAME"]; !ok && c.server.LookupRemoteHost {
+			c.lookupRemoteHost()
+		}
+	}
+
+	if name, ok := attrs["NAME"]; ok {
+		// The front-end only passes on a name it has verified
+		c.remoteHost, c.remoteHostVerified = name, name != ""
+	}
+
+	if helo, ok := attrs["HELO"]; ok {
+		c.xclientHelo = helo
+	}
+
+	if login, ok := attrs["LOGIN"]; ok {
+		c.authUser = login
+	}
+
+	c.logInfo("XCLIENT passed on client %s", strings.TrimSpace(arg))
+
+	c.esmtp = false
+	c.state = stateConnected
+	c.msg = message{}
+	return c.reply(220, c.server.hostname()+" "+c.greeting())
+}
+
+// xclientAddress builds the client address from the ADDR and PORT
+// attributes, starting from the current one. It returns nil if neither
+// changes it, and ok is false if either is malformed.
+func (c *connection) xclientAddress(attrs map[string]string) (net.Addr, bool) {
+	addrValue, portValue := attrs["ADDR"], attrs["PORT"]
+	if addrValue == "" && portValue == "" {
+		return nil, true
+	}
+
+	addr := &net.TCPAddr{}
+	if current, ok := c.clientAddr().(*net.TCPAddr); ok {
+		addr.IP, addr.Port = current.IP, current.Port
+	}
+
+	if addrValue != "" {
+		// IPv6 addresses are tagged, as in address literals
+		addr.IP = net.ParseIP(strings.TrimPrefix(strings.ToUpper(addrValue), "IPV6:"))
+		if addr.IP == nil {
+			return nil, false
+		}
+	}
+
+	if portValue != "" {
+		port, err := strconv.Atoi(portValue)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, false
+		}
+		addr.Port = port
+	}
+
+	// A port alone can't give an address to a Unix socket client
+	return addr, addr.IP != nil
+}
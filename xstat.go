@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// xstatAllowed reports whether the client may use XSTAT, see
+// Server.XStatAllowList. Like xclientAllowed, it goes by the address
+// the connection really comes from.
+func (c *connection) xstatAllowed() bool {
+	return c.server.Metrics != nil && containsIP(c.server.XStatAllowList, net.ParseIP(remoteIP(c.conn.RemoteAddr())))
+}
+
+// xstat handles XSTAT, which lists the server's statistics for a
+// client in Server.XStatAllowList. Anyone else is told the command is
+// unknown, the same as without Metrics.
+func (c *connection) xstat(arg string) error {
+	if !c.xstatAllowed() {
+		return c.reply(500, "5.5.2 Command not recognized")
+	}
+
+	m := c.server.Metrics
+
+	c.server.mu.Lock()
+	uptime := time.Duration(0)
+	if !c.server.started.IsZero() {
+		uptime = time.Since(c.server.started).Truncate(time.Second)
+	}
+	active := len(c.server.conns)
+	c.server.mu.Unlock()
+
+	rejections := m.rejectionCounts()
+	var codes []int
+	var rejected int64
+	for code, n := range rejections {
+		codes = append(codes, code)
+		rejected += n
+	}
+	sort.Ints(codes)
+
+	lines := []string{
+		c.server.hostname() + " statistics",
+		"Uptime: " + uptime.String(),
+		fmt.Sprintf("Active connections: %d", active),
+		fmt.Sprintf("Connections accepted: %d", atomic.LoadInt64(&m.connectionsAccepted)),
+		fmt.Sprintf("Messages received: %d (%d bytes)", atomic.LoadInt64(&m.messagesReceived), atomic.LoadInt64(&m.bytesReceived)),
+		fmt.Sprintf("Authentications: %d succeeded, %d failed", atomic.LoadInt64(&m.authSuccesses), atomic.LoadInt64(&m.authFailures)),
+		fmt.Sprintf("Rejections: %d", rejected),
+	}
+	for _, code := range codes {
+		lines = append(lines, fmt.Sprintf("Rejections with %d: %d", code, rejections[code]))
+	}
+	lines = append(lines, "End of statistics")
+
+	return c.replyLines(211, lines)
+}